@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -15,69 +17,319 @@ import (
 
 // ACLFilter implements the libp2p relay ACL interface.
 type ACLFilter struct {
-	allowPeers   map[peer.ID]struct{}
-	allowSubnets []*net.IPNet
+	host     host.Host
+	rules    atomic.Pointer[aclRules]
+	profiles map[string]ACLConfig
+	draining atomic.Bool
+	scores   *peerScores
+
+	// peers allowed through the DHT group record
+	group atomic.Pointer[map[peer.ID]struct{}]
+
+	// denied connections are logged at most once per second
+	connectDenyLog logLimiter
 
 	// peer address tracking for v1 relay ACL
 	mx    sync.RWMutex
 	addrs map[peer.ID]map[ma.Multiaddr]struct{}
 }
 
+// aclRules are the parsed rules of an ACL config, which are swapped
+// atomically when the active profile changes.
+type aclRules struct {
+	// in observe mode, decisions are counted but everything is allowed
+	observe bool
+	// disconnect peers holding reservations that are denied after an update
+	disconnectOnDeny bool
+	// deny reservations to peers advertising public addresses
+	rejectPublicAddrs bool
+	// deny reservations to peers scoring below; zero disables scoring
+	minScore float64
+	// cache of reservation decisions; nil if disabled
+	cache *decisionCache
+	// reservation rate limits; nil if disabled
+	rateLimits *rateLimitTiers
+
+	allowPeers       map[peer.ID]struct{}
+	allowSubnets     []*net.IPNet
+	allowConnectOnly map[peer.ID]struct{}
+}
+
 var _ relayv2.ACLFilter = (*ACLFilter)(nil)
 
+// DefaultACLProfile is the name of the profile corresponding to the top level
+// ACL config, unless overridden in the configured profiles.
+const DefaultACLProfile = "default"
+
 // NewACL returns an implementation of the relay ACL interface using the given
 // host and relay daemon ACL config.
 func NewACL(h host.Host, cfg ACLConfig) (*ACLFilter, error) {
-	acl := &ACLFilter{}
+	acl := &ACLFilter{
+		host:     h,
+		profiles: make(map[string]ACLConfig, len(cfg.Profiles)+1),
+		addrs:    make(map[peer.ID]map[ma.Multiaddr]struct{}),
+		scores:   newPeerScores(cfg.ScoreHalfLife),
+	}
+
+	acl.profiles[DefaultACLProfile] = cfg
+	for name, profile := range cfg.Profiles {
+		if _, err := parseACLRules(profile); err != nil {
+			return nil, fmt.Errorf("error parsing ACL profile %s: %w", name, err)
+		}
+		acl.profiles[name] = profile
+	}
+
+	if err := acl.Update(cfg); err != nil {
+		return nil, err
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    acl.Connected,
+		DisconnectedF: acl.Disconnected,
+	})
+
+	return acl, nil
+}
+
+// Update atomically replaces the enforced rules with the given ACL config.
+// If the config sets DisconnectOnDeny, peers holding a reservation that the
+// new rules deny are disconnected.
+func (a *ACLFilter) Update(cfg ACLConfig) error {
+	rules, err := parseACLRules(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.rules.Store(rules)
+
+	if rules.disconnectOnDeny && !rules.observe {
+		a.disconnectDenied(rules)
+	}
+
+	return nil
+}
+
+// disconnectDenied disconnects the peers holding a reservation, none of whose
+// connection addresses are allowed to reserve by the given rules.
+func (a *ACLFilter) disconnectDenied(rules *aclRules) {
+	for _, p := range ReservedPeers(a.host) {
+		allowed := false
+		for _, c := range a.host.Network().ConnsToPeer(p) {
+			if rules.allowReserve(p, c.RemoteMultiaddr(), a.groupPeers()) {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			continue
+		}
+
+		Infof("Disconnecting %s, whose reservation is denied after the ACL update\n", p)
+		a.host.Network().ClosePeer(p)
+		aclReloadDisconnects.Inc()
+	}
+}
+
+// SetProfile atomically replaces the enforced rules with the named profile.
+func (a *ACLFilter) SetProfile(name string) error {
+	cfg, ok := a.profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown ACL profile: %s", name)
+	}
+
+	return a.Update(cfg)
+}
+
+func parseACLRules(cfg ACLConfig) (*aclRules, error) {
+	rules := &aclRules{}
+
+	rules.disconnectOnDeny = cfg.DisconnectOnDeny
+	rules.rejectPublicAddrs = cfg.RejectReservationsWithPublicAddrs
+
+	if cfg.MinScore > 0 {
+		return nil, fmt.Errorf("invalid ACL minimum score: %g; scores are never positive", cfg.MinScore)
+	}
+	rules.minScore = cfg.MinScore
+
+	if cfg.DecisionCacheSize > 0 {
+		rules.cache = newDecisionCache(cfg.DecisionCacheSize, cfg.DecisionCacheTTL)
+	}
+
+	rateLimits, err := parseRateLimitTiers(cfg.RateLimitTiers)
+	if err != nil {
+		return nil, err
+	}
+	rules.rateLimits = rateLimits
+
+	switch cfg.Mode {
+	case "", "enforce":
+	case "observe":
+		rules.observe = true
+	default:
+		return nil, fmt.Errorf("unknown ACL mode: %s", cfg.Mode)
+	}
 
 	if len(cfg.AllowPeers) > 0 {
-		acl.allowPeers = make(map[peer.ID]struct{})
+		rules.allowPeers = make(map[peer.ID]struct{})
 		for _, s := range cfg.AllowPeers {
 			p, err := peer.Decode(s)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing peer ID: %w", err)
 			}
 
-			acl.allowPeers[p] = struct{}{}
+			rules.allowPeers[p] = struct{}{}
+		}
+	}
+
+	if len(cfg.AllowConnectOnly) > 0 {
+		rules.allowConnectOnly = make(map[peer.ID]struct{})
+		for _, s := range cfg.AllowConnectOnly {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer ID: %w", err)
+			}
+
+			rules.allowConnectOnly[p] = struct{}{}
 		}
 	}
 
 	if len(cfg.AllowSubnets) > 0 {
-		acl.allowSubnets = make([]*net.IPNet, 0, len(cfg.AllowSubnets))
+		rules.allowSubnets = make([]*net.IPNet, 0, len(cfg.AllowSubnets))
 		for _, s := range cfg.AllowSubnets {
 			_, ipnet, err := net.ParseCIDR(s)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing subnet: %w", err)
 			}
-			acl.allowSubnets = append(acl.allowSubnets, ipnet)
+			rules.allowSubnets = append(rules.allowSubnets, ipnet)
 		}
+	}
+
+	return rules, nil
+}
+
+// SetDraining enables or disables drain mode, in which all reservations are
+// denied so that clients move to other relays.
+func (a *ACLFilter) SetDraining(draining bool) {
+	a.draining.Store(draining)
+}
 
-		acl.addrs = make(map[peer.ID]map[ma.Multiaddr]struct{})
-		h.Network().Notify(&network.NotifyBundle{
-			ConnectedF:    acl.Connected,
-			DisconnectedF: acl.Disconnected,
-		})
+// Open returns true if the active rules allow any peer to make reservations.
+func (a *ACLFilter) Open() bool {
+	rules := a.rules.Load()
+	if rules.observe {
+		return true
 	}
 
-	return acl, nil
+	return len(rules.allowPeers) == 0 && len(rules.allowSubnets) == 0 && len(a.groupPeers()) == 0
 }
 
 // AllowReserve is relevant for the relayv2 ACL implementation.
-func (a *ACLFilter) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
-	if len(a.allowPeers) > 0 {
-		_, ok := a.allowPeers[p]
-		if !ok {
-			return false
+// Connect-only peers are never allowed to make reservations, and no peer is
+// while draining. A panic denies the reservation.
+func (a *ACLFilter) AllowReserve(p peer.ID, addr ma.Multiaddr) (allow bool) {
+	defer recoverPanic("acl_reserve")
+
+	if a.draining.Load() {
+		counterWith(reservationsRejected, "reservations_rejected", "draining").Inc()
+		return false
+	}
+
+	rules := a.rules.Load()
+	score := a.scores.reserve(p)
+
+	if !a.allowReserve(rules, p, addr) {
+		a.scores.penalize(p)
+		if rules.observe {
+			fmt.Printf("ACL observe: would deny reservation for %s from %s\n", p, addr)
+			counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "deny_policy").Inc()
+			return true
 		}
+		return false
 	}
 
-	if len(a.allowSubnets) > 0 {
+	if rules.minScore < 0 && score < rules.minScore {
+		if rules.observe {
+			fmt.Printf("ACL observe: would deny reservation for %s with score %.1f\n", p, score)
+			counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "score").Inc()
+			return true
+		}
+		counterWith(reservationsRejected, "reservations_rejected", "score").Inc()
+		return false
+	}
+
+	if tier := rules.rateLimits.tier(p, addr); tier != nil && !tier.allow(p) {
+		if rules.observe {
+			fmt.Printf("ACL observe: would deny reservation for %s over the %s rate limit\n", p, tier.name)
+			counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "rate_limit").Inc()
+			return true
+		}
+		counterWith(reservationsRejected, "reservations_rejected", "rate_limit").Inc()
+		return false
+	}
+
+	if rules.rejectPublicAddrs && hasPublicAddr(a.host.Peerstore().Addrs(p)) {
+		if rules.observe {
+			fmt.Printf("ACL observe: would deny reservation for %s with public addresses\n", p)
+			counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "public_addrs").Inc()
+			return true
+		}
+		counterWith(reservationsRejected, "reservations_rejected", "public_addrs").Inc()
+		return false
+	}
+
+	return true
+}
+
+// allowReserve evaluates the rules for a reservation, using the decision
+// cache of the rules if enabled.
+func (a *ACLFilter) allowReserve(rules *aclRules, p peer.ID, addr ma.Multiaddr) bool {
+	key := decisionKey{peer: p, op: "reserve"}
+	if ip, err := manet.ToIP(addr); err == nil {
+		key.ip = ip.String()
+	} else {
+		key.ip = addr.String()
+	}
+
+	if allow, ok := rules.cache.get(key); ok {
+		return allow
+	}
+
+	allow := rules.allowReserve(p, addr, a.groupPeers())
+	rules.cache.put(key, allow)
+	return allow
+}
+
+// hasPublicAddr returns true if any of the given addresses is a public
+// address, not counting relay addresses.
+func hasPublicAddr(addrs []ma.Multiaddr) bool {
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		if manet.IsPublicAddr(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rules *aclRules) allowReserve(p peer.ID, addr ma.Multiaddr, group map[peer.ID]struct{}) bool {
+	if _, ok := rules.allowConnectOnly[p]; ok {
+		return false
+	}
+
+	if !rules.allowPeer(p, group) {
+		return false
+	}
+
+	if len(rules.allowSubnets) > 0 {
 		ip, err := manet.ToIP(addr)
 		if err != nil {
 			return false
 		}
 
-		for _, ipnet := range a.allowSubnets {
+		for _, ipnet := range rules.allowSubnets {
 			if ipnet.Contains(ip) {
 				return true
 			}
@@ -89,22 +341,140 @@ func (a *ACLFilter) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
 	return true
 }
 
-// AllowConnect is always true, as we are accepting any public node to be able
-// to contact the nodes allowed to make reservations through this relay.
-func (a *ACLFilter) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
-	return true
+// allowPeer checks the peer against the allowed peers, including the peers of
+// the group record; if there are none, all peers are allowed.
+func (rules *aclRules) allowPeer(p peer.ID, group map[peer.ID]struct{}) bool {
+	if len(rules.allowPeers) == 0 && len(group) == 0 {
+		return true
+	}
+
+	if _, ok := rules.allowPeers[p]; ok {
+		return true
+	}
+	_, ok := group[p]
+	return ok
 }
 
-// AllowHop is relevant for relayv1 ACL implementation.
-func (a *ACLFilter) AllowHop(src, dest peer.ID) bool {
-	if len(a.allowPeers) > 0 {
-		_, ok := a.allowPeers[dest]
-		if !ok {
-			return false
+func (a *ACLFilter) groupPeers() map[peer.ID]struct{} {
+	if group := a.group.Load(); group != nil {
+		return *group
+	}
+	return nil
+}
+
+// AllowConnect accepts any source unless connect-only peers are configured,
+// in which case the source must be a connect-only peer or be allowed to make
+// reservations; otherwise we are accepting any public node to be able to
+// contact the nodes allowed to make reservations through this relay. The
+// destination must still be allowed, which it may no longer be if the rules
+// changed since it made its reservation; the relay then answers with
+// PERMISSION_DENIED. Sources of circuit requests that fail, because the
+// destination is denied or holds no reservation, are penalized once per
+// request in the peer scores, except in observe mode. A panic denies the
+// connection.
+func (a *ACLFilter) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) (allow bool) {
+	defer recoverPanic("acl_connect")
+
+	rules := a.rules.Load()
+
+	if !rules.allowSource(src, srcAddr, a.groupPeers()) {
+		if rules.observe {
+			fmt.Printf("ACL observe: would deny connection from %s to %s\n", src, dest)
+			counterWith(aclObservedDenials, "acl_observed_denials", "connect", "src_not_allowed").Inc()
+			return true
 		}
+
+		if a.connectDenyLog.allow(time.Now()) {
+			Infof("ACL: denied connection from %s to %s: source not allowed\n", src, dest)
+		}
+		counterWith(connectDenied, "connect_denied", "src_not_allowed").Inc()
+		return false
+	}
+
+	// the circuit fails if the destination is denied or holds no
+	// reservation, which penalizes the source once
+	allowed := a.allowDest(rules, dest)
+	if !rules.observe && (!allowed || !hasReservation(a.host, dest)) {
+		a.scores.penalize(src)
+	}
+
+	if allowed {
+		return true
+	}
+
+	if rules.observe {
+		fmt.Printf("ACL observe: would deny connection from %s to %s\n", src, dest)
+		counterWith(aclObservedDenials, "acl_observed_denials", "connect", "dest_not_allowed").Inc()
+		return true
+	}
+
+	if a.connectDenyLog.allow(time.Now()) {
+		Infof("ACL: denied connection from %s to %s: destination not allowed\n", src, dest)
+	}
+	counterWith(connectDenied, "connect_denied", "dest_not_allowed").Inc()
+	return false
+}
+
+// allowSource checks a circuit source: if there are connect-only peers, the
+// source must be one of them or be allowed to make reservations from its
+// address; otherwise any source is allowed.
+func (rules *aclRules) allowSource(src peer.ID, srcAddr ma.Multiaddr, group map[peer.ID]struct{}) bool {
+	if len(rules.allowConnectOnly) == 0 {
+		return true
+	}
+	if _, ok := rules.allowConnectOnly[src]; ok {
+		return true
+	}
+
+	return rules.allowReserve(src, srcAddr, group)
+}
+
+// allowDest checks a circuit destination against the reservation rules: the
+// destination must be an allowed peer and, if subnets are configured, be
+// connected from an allowed subnet, as required to make its reservation.
+func (a *ACLFilter) allowDest(rules *aclRules, dest peer.ID) bool {
+	group := a.groupPeers()
+	if !rules.allowPeer(dest, group) {
+		return false
+	}
+	if len(rules.allowSubnets) == 0 {
+		return true
+	}
+
+	for _, c := range a.host.Network().ConnsToPeer(dest) {
+		if rules.allowReserve(dest, c.RemoteMultiaddr(), group) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowHop is relevant for relayv1 ACL implementation. A panic denies the
+// hop.
+func (a *ACLFilter) AllowHop(src, dest peer.ID) (allow bool) {
+	defer recoverPanic("acl_hop")
+
+	rules := a.rules.Load()
+
+	if a.allowHop(rules, dest) {
+		return true
+	}
+
+	if rules.observe {
+		fmt.Printf("ACL observe: would deny hop from %s to %s\n", src, dest)
+		counterWith(aclObservedDenials, "acl_observed_denials", "hop", "deny_policy").Inc()
+		return true
+	}
+
+	return false
+}
+
+func (a *ACLFilter) allowHop(rules *aclRules, dest peer.ID) bool {
+	if !rules.allowPeer(dest, a.groupPeers()) {
+		return false
 	}
 
-	if len(a.allowSubnets) > 0 {
+	if len(rules.allowSubnets) > 0 {
 		a.mx.RLock()
 		defer a.mx.RUnlock()
 
@@ -115,7 +485,7 @@ func (a *ACLFilter) AllowHop(src, dest peer.ID) bool {
 				continue
 			}
 
-			for _, ipnet := range a.allowSubnets {
+			for _, ipnet := range rules.allowSubnets {
 				if ipnet.Contains(ip) {
 					return true
 				}
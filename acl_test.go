@@ -0,0 +1,353 @@
+package relaydaemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestACLAllowConnect(t *testing.T) {
+	allowed := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+	src := test.RandPeerIDFatal(t)
+
+	for _, tc := range []struct {
+		name  string
+		cfg   ACLConfig
+		dest  peer.ID
+		conns []string
+		want  bool
+	}{
+		{name: "open relay", dest: other, conns: []string{"1.2.3.4"}, want: true},
+		{name: "allowed peer", cfg: ACLConfig{AllowPeers: []string{allowed.String()}}, dest: allowed, want: true},
+		{name: "peer not allowed", cfg: ACLConfig{AllowPeers: []string{allowed.String()}}, dest: other, want: false},
+		{name: "allowed subnet", cfg: ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, dest: other, conns: []string{"10.1.2.3"}, want: true},
+		{name: "any allowed subnet", cfg: ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, dest: other, conns: []string{"1.2.3.4", "10.1.2.3"}, want: true},
+		{name: "subnet not allowed", cfg: ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, dest: other, conns: []string{"1.2.3.4"}, want: false},
+		{name: "subnet without connections", cfg: ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, dest: other, want: false},
+		{
+			name:  "allowed peer from subnet not allowed",
+			cfg:   ACLConfig{AllowPeers: []string{allowed.String()}, AllowSubnets: []string{"10.0.0.0/8"}},
+			dest:  allowed,
+			conns: []string{"1.2.3.4"},
+			want:  false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			h.net.conns = make(map[peer.ID][]network.Conn)
+			h.reserve(tc.dest)
+			for i, ip := range tc.conns {
+				h.net.conns[tc.dest] = append(h.net.conns[tc.dest], newTestConn(ip, 4001+i, network.DirInbound))
+			}
+
+			acl, err := NewACL(h, tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			denied := testutil.ToFloat64(counterWith(connectDenied, "connect_denied", "dest_not_allowed"))
+			if got := acl.AllowConnect(src, nil, tc.dest); got != tc.want {
+				t.Fatalf("got %t, want %t", got, tc.want)
+			}
+
+			wantDenied := denied
+			if !tc.want {
+				wantDenied++
+			}
+			if got := testutil.ToFloat64(counterWith(connectDenied, "connect_denied", "dest_not_allowed")); got != wantDenied {
+				t.Fatalf("%f denials counted, want %f", got, wantDenied)
+			}
+		})
+	}
+}
+
+func TestACLProfiles(t *testing.T) {
+	allowed := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	acl, err := NewACL(newTestHost(), ACLConfig{
+		Profiles: map[string]ACLConfig{
+			"lockdown": {AllowPeers: []string{allowed.String()}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !acl.AllowReserve(other, addr) {
+		t.Fatal("expected the default profile to allow any peer")
+	}
+
+	if err := acl.SetProfile("lockdown"); err != nil {
+		t.Fatal(err)
+	}
+	if acl.AllowReserve(other, addr) {
+		t.Fatal("expected the lockdown profile to deny peers not allowed")
+	}
+	if !acl.AllowReserve(allowed, addr) {
+		t.Fatal("expected the lockdown profile to allow the allowed peer")
+	}
+
+	if err := acl.SetProfile("unknown"); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+	if acl.AllowReserve(other, addr) {
+		t.Fatal("expected an unknown profile to keep the active rules")
+	}
+
+	if err := acl.SetProfile(DefaultACLProfile); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.AllowReserve(other, addr) {
+		t.Fatal("expected the default profile to be restored")
+	}
+}
+
+func TestACLConnectOnly(t *testing.T) {
+	client := test.RandPeerIDFatal(t)
+	reserver := test.RandPeerIDFatal(t)
+	dest := test.RandPeerIDFatal(t)
+	stranger := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	h := newTestHost()
+	h.reserve(dest)
+
+	acl, err := NewACL(h, ACLConfig{
+		AllowPeers:       []string{client.String(), reserver.String(), dest.String()},
+		AllowConnectOnly: []string{client.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acl.AllowReserve(client, addr) {
+		t.Fatal("expected connect-only peers to be denied reservations")
+	}
+	if !acl.AllowReserve(reserver, addr) {
+		t.Fatal("expected allowed peers to make reservations")
+	}
+
+	if !acl.AllowConnect(client, addr, dest) {
+		t.Fatal("expected connect-only peers to connect through the relay")
+	}
+	if !acl.AllowConnect(reserver, addr, dest) {
+		t.Fatal("expected peers allowed to reserve to connect through the relay")
+	}
+
+	denied := testutil.ToFloat64(counterWith(connectDenied, "connect_denied", "src_not_allowed"))
+	if acl.AllowConnect(stranger, addr, dest) {
+		t.Fatal("expected other sources to be denied")
+	}
+	if got := testutil.ToFloat64(counterWith(connectDenied, "connect_denied", "src_not_allowed")); got != denied+1 {
+		t.Fatalf("%g source denials counted, want %g", got, denied+1)
+	}
+}
+
+func TestACLConnectOnlyOpenRelay(t *testing.T) {
+	client := test.RandPeerIDFatal(t)
+	dest := test.RandPeerIDFatal(t)
+	stranger := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	h := newTestHost()
+	h.reserve(dest)
+
+	acl, err := NewACL(h, ACLConfig{AllowConnectOnly: []string{client.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acl.AllowReserve(client, addr) {
+		t.Fatal("expected connect-only peers to be denied reservations")
+	}
+	if !acl.AllowConnect(client, addr, dest) {
+		t.Fatal("expected connect-only peers to connect through the relay")
+	}
+	if !acl.AllowConnect(stranger, addr, dest) {
+		t.Fatal("expected an open relay to accept any other source")
+	}
+}
+
+func TestACLObserveMode(t *testing.T) {
+	allowed := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	for _, tc := range []struct {
+		mode    string
+		allow   bool
+		observe float64
+	}{
+		{mode: "enforce", allow: false, observe: 0},
+		{mode: "observe", allow: true, observe: 1},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			acl, err := NewACL(newTestHost(), ACLConfig{Mode: tc.mode, AllowPeers: []string{allowed.String()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			observed := testutil.ToFloat64(counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "deny_policy"))
+			if got := acl.AllowReserve(other, addr); got != tc.allow {
+				t.Fatalf("got %t, want %t", got, tc.allow)
+			}
+			if got := testutil.ToFloat64(counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "deny_policy")); got != observed+tc.observe {
+				t.Fatalf("%g observed denials counted, want %g", got-observed, tc.observe)
+			}
+
+			// allowed reservations are not counted
+			if !acl.AllowReserve(allowed, addr) {
+				t.Fatal("allowed peer denied")
+			}
+			if got := testutil.ToFloat64(counterWith(aclObservedDenials, "acl_observed_denials", "reserve", "deny_policy")); got != observed+tc.observe {
+				t.Fatalf("%g observed denials counted, want %g", got-observed, tc.observe)
+			}
+		})
+	}
+
+	if _, err := NewACL(newTestHost(), ACLConfig{Mode: "permissive"}); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestACLDisconnectOnDeny(t *testing.T) {
+	kept := test.RandPeerIDFatal(t)
+	denied := test.RandPeerIDFatal(t)
+
+	for _, tc := range []struct {
+		name             string
+		disconnectOnDeny bool
+		mode             string
+		want             []peer.ID
+	}{
+		{name: "disconnect", disconnectOnDeny: true, want: []peer.ID{denied}},
+		{name: "retain", disconnectOnDeny: false},
+		{name: "observe", disconnectOnDeny: true, mode: "observe"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			h.net.conns = make(map[peer.ID][]network.Conn)
+			for i, p := range []peer.ID{kept, denied} {
+				h.reserve(p)
+				h.net.conns[p] = []network.Conn{newTestConn("1.2.3.4", 4001+i, network.DirInbound)}
+			}
+
+			acl, err := NewACL(h, ACLConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			disconnects := testutil.ToFloat64(aclReloadDisconnects)
+			err = acl.Update(ACLConfig{
+				Mode:             tc.mode,
+				AllowPeers:       []string{kept.String()},
+				DisconnectOnDeny: tc.disconnectOnDeny,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(h.net.closed, tc.want) {
+				t.Fatalf("disconnected %v, want %v", h.net.closed, tc.want)
+			}
+			if got := testutil.ToFloat64(aclReloadDisconnects); got != disconnects+float64(len(tc.want)) {
+				t.Fatalf("%g disconnects counted, want %d", got-disconnects, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestACLDraining(t *testing.T) {
+	p := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	acl, err := NewACL(newTestHost(), ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := testutil.ToFloat64(counterWith(reservationsRejected, "reservations_rejected", "draining"))
+	if !acl.AllowReserve(p, addr) {
+		t.Fatal("reservation denied before draining")
+	}
+
+	acl.SetDraining(true)
+	if acl.AllowReserve(p, addr) {
+		t.Fatal("reservation allowed while draining")
+	}
+	if got := testutil.ToFloat64(counterWith(reservationsRejected, "reservations_rejected", "draining")); got != rejected+1 {
+		t.Fatalf("%g rejected reservations counted, want 1", got-rejected)
+	}
+
+	acl.SetDraining(false)
+	if !acl.AllowReserve(p, addr) {
+		t.Fatal("reservation denied after draining")
+	}
+	if got := testutil.ToFloat64(counterWith(reservationsRejected, "reservations_rejected", "draining")); got != rejected+1 {
+		t.Fatalf("%g rejected reservations counted, want 1", got-rejected)
+	}
+}
+
+func TestACLRejectPublicAddrs(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	relay := test.RandPeerIDFatal(t)
+	public := test.RandPeerIDFatal(t)
+	private := test.RandPeerIDFatal(t)
+	unknown := test.RandPeerIDFatal(t)
+	ps.AddAddrs(public, []ma.Multiaddr{
+		ma.StringCast("/ip4/192.168.1.2/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+	}, time.Hour)
+	ps.AddAddrs(private, []ma.Multiaddr{
+		ma.StringCast("/ip4/192.168.1.3/tcp/4001"),
+		ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + relay.String() + "/p2p-circuit"),
+	}, time.Hour)
+	addr := ma.StringCast("/ip4/9.9.9.9/tcp/4001")
+
+	for _, tc := range []struct {
+		name   string
+		reject bool
+		want   map[peer.ID]bool
+	}{
+		{name: "disabled", reject: false, want: map[peer.ID]bool{public: true, private: true, unknown: true}},
+		{name: "enabled", reject: true, want: map[peer.ID]bool{public: false, private: true, unknown: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			h.net.ps = ps
+			acl, err := NewACL(h, ACLConfig{RejectReservationsWithPublicAddrs: tc.reject})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rejected := testutil.ToFloat64(counterWith(reservationsRejected, "reservations_rejected", "public_addrs"))
+			denied := 0
+			for p, want := range tc.want {
+				if got := acl.AllowReserve(p, addr); got != want {
+					t.Errorf("%s: got %t, want %t", p, got, want)
+				}
+				if !want {
+					denied++
+				}
+			}
+			if got := testutil.ToFloat64(counterWith(reservationsRejected, "reservations_rejected", "public_addrs")); got != rejected+float64(denied) {
+				t.Fatalf("%g rejected reservations counted, want %d", got-rejected, denied)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package relaydaemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/host"
+	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// dnsFailureGrace is the number of consecutive failed resolutions after which
+// a DNS announce address is no longer announced.
+const dnsFailureGrace = 3
+
+// ErrNoListenAddr is returned when none of the listen addresses could be bound.
+var ErrNoListenAddr = errors.New("no listen address could be bound; check ports/permissions")
+
+// Listen makes the host listen on the listen addresses of the given relay
+// daemon network config. Unless AllowNoListen is set, it fails with
+// ErrNoListenAddr if none of them can be bound.
+func Listen(h host.Host, cfg NetworkConfig) error {
+	addrs := make([]ma.Multiaddr, 0, len(cfg.ListenAddrs))
+	for _, s := range cfg.ListenAddrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return fmt.Errorf("error parsing listen address: %w", err)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	if err := h.Network().Listen(addrs...); err != nil {
+		if cfg.AllowNoListen {
+			fmt.Printf("No listen address could be bound, continuing without listening: %s\n", err)
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrNoListenAddr, err)
+	}
+
+	return nil
+}
+
+// Resolver resolves DNS multiaddrs.
+type Resolver interface {
+	Resolve(ctx context.Context, maddr ma.Multiaddr) ([]ma.Multiaddr, error)
+}
+
+var _ Resolver = (*madns.Resolver)(nil)
+
+// NewResolver returns the DNS multiaddr resolver for the given relay daemon
+// network config, which uses the configured DNSResolver server if set and
+// the system resolver otherwise.
+func NewResolver(cfg NetworkConfig) (*madns.Resolver, error) {
+	if cfg.DNSResolver == "" {
+		return madns.NewResolver()
+	}
+
+	server := cfg.DNSResolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	var d net.Dialer
+	return madns.NewResolver(madns.WithDefaultResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, server)
+		},
+	}))
+}
+
+// Announcer determines the addresses the host announces, using the relay
+// daemon network config.
+// If AnnounceAddrs are configured, these are announced verbatim; otherwise
+// the public listen addresses are announced, optionally restricted to the
+// configured AnnounceCIDRs, and listen addresses matching AnnounceOverrides
+// are announced in their overridden form.
+type Announcer struct {
+	clock clock.Clock
+
+	announce  []ma.Multiaddr
+	cidrs     []*net.IPNet
+	overrides []announceOverride
+
+	maxTransportsPerIP  int
+	transportPreference []string
+
+	// DNS announce address rechecking
+	mx       sync.RWMutex
+	failures map[string]int
+}
+
+// NewAnnouncer returns an announcer for the given relay daemon network config.
+func NewAnnouncer(cfg NetworkConfig) (*Announcer, error) {
+	a := &Announcer{
+		clock:               clock.New(),
+		failures:            make(map[string]int),
+		maxTransportsPerIP:  cfg.MaxAnnouncedTransportsPerIP,
+		transportPreference: cfg.AnnouncedTransportPreference,
+	}
+
+	for _, s := range cfg.AnnounceAddrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing announce address: %w", err)
+		}
+		a.announce = append(a.announce, addr)
+	}
+
+	for _, s := range cfg.AnnounceCIDRs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing announce CIDR: %w", err)
+		}
+		a.cidrs = append(a.cidrs, ipnet)
+	}
+
+	for listen, announce := range cfg.AnnounceOverrides {
+		o, err := newAnnounceOverride(listen, announce)
+		if err != nil {
+			return nil, err
+		}
+		a.overrides = append(a.overrides, o)
+	}
+	// most specific overrides first, ties broken by listen address so that
+	// the precedence does not depend on the map order
+	sort.Slice(a.overrides, func(i, j int) bool {
+		oi, oj := a.overrides[i], a.overrides[j]
+		if len(oi.listen) != len(oj.listen) {
+			return len(oi.listen) > len(oj.listen)
+		}
+		return oi.key < oj.key
+	})
+
+	return a, nil
+}
+
+// announceOverride replaces the listen address prefix of matching addresses
+// with an announce address prefix.
+type announceOverride struct {
+	key      string
+	listen   []ma.Multiaddr
+	announce ma.Multiaddr
+}
+
+func newAnnounceOverride(listen, announce string) (announceOverride, error) {
+	l, err := ma.NewMultiaddr(listen)
+	if err != nil {
+		return announceOverride{}, fmt.Errorf("error parsing announce override: %w", err)
+	}
+	a, err := ma.NewMultiaddr(announce)
+	if err != nil {
+		return announceOverride{}, fmt.Errorf("error parsing announce override: %w", err)
+	}
+
+	return announceOverride{key: listen, listen: ma.Split(l), announce: a}, nil
+}
+
+// apply returns the overridden address if the given address starts with the
+// listen address prefix of the override.
+func (o announceOverride) apply(addr ma.Multiaddr) (ma.Multiaddr, bool) {
+	comps := ma.Split(addr)
+	if len(comps) < len(o.listen) {
+		return nil, false
+	}
+	for i, c := range o.listen {
+		if !comps[i].Equal(c) {
+			return nil, false
+		}
+	}
+
+	if len(comps) == len(o.listen) {
+		return o.announce, true
+	}
+	return o.announce.Encapsulate(ma.Join(comps[len(o.listen):]...)), true
+}
+
+// Addrs returns the addresses to announce given the host's listen addresses;
+// it is used as the host's address factory.
+func (a *Announcer) Addrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(a.announce) > 0 {
+		a.mx.RLock()
+		defer a.mx.RUnlock()
+
+		announce := make([]ma.Multiaddr, 0, len(a.announce))
+		for _, addr := range a.announce {
+			if a.failures[addr.String()] < dnsFailureGrace {
+				announce = append(announce, addr)
+			}
+		}
+		return announce
+	}
+
+	announce := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if overridden, ok := a.override(addr); ok {
+			announce = append(announce, overridden)
+			continue
+		}
+		if manet.IsPublicAddr(addr) && inCIDRs(addr, a.cidrs) {
+			announce = append(announce, addr)
+		}
+	}
+	return a.capTransports(announce)
+}
+
+// capTransports keeps the addresses of at most the maximum number of
+// transports per IP, in the order of the transport preference. Addresses
+// without an IP are kept.
+func (a *Announcer) capTransports(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if a.maxTransportsPerIP <= 0 {
+		return addrs
+	}
+
+	rank := make(map[string]int, len(a.transportPreference))
+	for i, t := range a.transportPreference {
+		rank[t] = i
+	}
+	rankOf := func(t string) int {
+		if r, ok := rank[t]; ok {
+			return r
+		}
+		return len(rank)
+	}
+
+	// transports announced for each IP
+	transports := make(map[string]map[string]struct{})
+	for _, addr := range addrs {
+		ip, err := manet.ToIP(addr)
+		if err != nil {
+			continue
+		}
+		if transports[ip.String()] == nil {
+			transports[ip.String()] = make(map[string]struct{})
+		}
+		transports[ip.String()][addrTransport(addr)] = struct{}{}
+	}
+	for _, ts := range transports {
+		if len(ts) <= a.maxTransportsPerIP {
+			continue
+		}
+
+		sorted := make([]string, 0, len(ts))
+		for t := range ts {
+			sorted = append(sorted, t)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if rankOf(sorted[i]) != rankOf(sorted[j]) {
+				return rankOf(sorted[i]) < rankOf(sorted[j])
+			}
+			return sorted[i] < sorted[j]
+		})
+		for _, t := range sorted[a.maxTransportsPerIP:] {
+			delete(ts, t)
+		}
+	}
+
+	capped := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ip, err := manet.ToIP(addr)
+		if err != nil {
+			capped = append(capped, addr)
+			continue
+		}
+		if _, ok := transports[ip.String()][addrTransport(addr)]; ok {
+			capped = append(capped, addr)
+		}
+	}
+	return capped
+}
+
+// addrTransport returns the transport of the given address: "webtransport",
+// "websocket", "quic", "tcp" or otherwise the name of its last protocol.
+func addrTransport(addr ma.Multiaddr) string {
+	has := func(code int) bool {
+		_, err := addr.ValueForProtocol(code)
+		return err == nil
+	}
+
+	switch {
+	case has(ma.P_WEBTRANSPORT):
+		return "webtransport"
+	case has(ma.P_WS) || has(ma.P_WSS):
+		return "websocket"
+	case has(ma.P_QUIC_V1) || has(ma.P_QUIC):
+		return "quic"
+	case has(ma.P_TCP):
+		return "tcp"
+	}
+
+	protos := addr.Protocols()
+	return protos[len(protos)-1].Name
+}
+
+func (a *Announcer) override(addr ma.Multiaddr) (ma.Multiaddr, bool) {
+	for _, o := range a.overrides {
+		if overridden, ok := o.apply(addr); ok {
+			return overridden, true
+		}
+	}
+	return nil, false
+}
+
+// RecheckDNS periodically resolves the DNS announce addresses with the given
+// resolver until the context is done. Addresses that repeatedly fail to
+// resolve stop being announced, until they resolve again.
+func (a *Announcer) RecheckDNS(ctx context.Context, resolver Resolver, interval time.Duration) {
+	var dnsAddrs []ma.Multiaddr
+	for _, addr := range a.announce {
+		if madns.Matches(addr) {
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+	}
+	if len(dnsAddrs) == 0 {
+		return
+	}
+
+	ticker := a.clock.Ticker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range dnsAddrs {
+			resolved, err := resolver.Resolve(ctx, addr)
+			ok := err == nil && len(resolved) > 0
+
+			a.mx.Lock()
+			if ok {
+				if a.failures[addr.String()] >= dnsFailureGrace {
+					Infof("Announce address %s resolves again\n", addr)
+				}
+				delete(a.failures, addr.String())
+			} else {
+				a.failures[addr.String()]++
+				if a.failures[addr.String()] == dnsFailureGrace {
+					fmt.Printf("Announce address %s does not resolve; no longer announcing it\n", addr)
+				}
+			}
+			a.mx.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// inCIDRs returns true if the given address is contained in any of the given
+// CIDRs, or if there are no CIDRs.
+func inCIDRs(a ma.Multiaddr, cidrs []*net.IPNet) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	ip, err := manet.ToIP(a)
+	if err != nil {
+		return false
+	}
+
+	for _, ipnet := range cidrs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,331 @@
+package relaydaemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p"
+	"github.com/miekg/dns"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestAnnouncerAddrs(t *testing.T) {
+	listen := []string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/10.0.0.1/tcp/4001",
+		"/ip4/1.2.3.4/tcp/4001",
+		"/ip4/1.2.3.4/udp/4001/quic-v1",
+		"/ip4/1.2.3.4/udp/4001/quic-v1/webtransport",
+		"/ip4/5.6.7.8/tcp/4001",
+		"/ip6/fe80::1/tcp/4001",
+	}
+
+	for _, tc := range []struct {
+		name string
+		cfg  NetworkConfig
+		want []string
+	}{
+		{
+			name: "public addresses",
+			want: []string{
+				"/ip4/1.2.3.4/tcp/4001",
+				"/ip4/1.2.3.4/udp/4001/quic-v1",
+				"/ip4/1.2.3.4/udp/4001/quic-v1/webtransport",
+				"/ip4/5.6.7.8/tcp/4001",
+			},
+		},
+		{
+			name: "announce addresses are verbatim",
+			cfg:  NetworkConfig{AnnounceAddrs: []string{"/dns4/relay.example.com/tcp/4001"}},
+			want: []string{"/dns4/relay.example.com/tcp/4001"},
+		},
+		{
+			name: "CIDRs",
+			cfg:  NetworkConfig{AnnounceCIDRs: []string{"5.6.7.0/24"}},
+			want: []string{"/ip4/5.6.7.8/tcp/4001"},
+		},
+		{
+			name: "overrides",
+			cfg: NetworkConfig{
+				AnnounceCIDRs: []string{"5.6.7.0/24"},
+				AnnounceOverrides: map[string]string{
+					"/ip4/10.0.0.1":          "/ip4/9.9.9.9",
+					"/ip4/10.0.0.1/tcp/4001": "/ip4/8.8.8.8/tcp/443",
+				},
+			},
+			want: []string{"/ip4/8.8.8.8/tcp/443", "/ip4/5.6.7.8/tcp/4001"},
+		},
+		{
+			name: "overrides keep the rest of the address",
+			cfg: NetworkConfig{
+				AnnounceCIDRs:     []string{"5.6.7.0/24"},
+				AnnounceOverrides: map[string]string{"/ip4/10.0.0.1": "/ip4/9.9.9.9"},
+			},
+			want: []string{"/ip4/9.9.9.9/tcp/4001", "/ip4/5.6.7.8/tcp/4001"},
+		},
+		{
+			name: "transport cap by preference",
+			cfg: NetworkConfig{
+				MaxAnnouncedTransportsPerIP:  1,
+				AnnouncedTransportPreference: []string{"quic", "tcp"},
+			},
+			want: []string{"/ip4/1.2.3.4/udp/4001/quic-v1", "/ip4/5.6.7.8/tcp/4001"},
+		},
+		{
+			name: "transport cap without preference",
+			cfg:  NetworkConfig{MaxAnnouncedTransportsPerIP: 2},
+			want: []string{
+				"/ip4/1.2.3.4/tcp/4001",
+				"/ip4/1.2.3.4/udp/4001/quic-v1",
+				"/ip4/5.6.7.8/tcp/4001",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAnnouncer(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0, len(tc.want))
+			for _, addr := range a.Addrs(parseTestAddrs(t, listen)) {
+				got = append(got, addr.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAnnouncerOverrideOrder(t *testing.T) {
+	overrides := map[string]string{
+		"/ip4/10.0.0.2/tcp/4001": "/ip4/2.2.2.2/tcp/4001",
+		"/ip4/10.0.0.1":          "/ip4/1.1.1.1",
+		"/ip4/10.0.0.1/tcp/4001": "/ip4/1.1.1.1/tcp/443",
+		"/ip4/10.0.0.2":          "/ip4/2.2.2.2",
+	}
+	want := []string{
+		"/ip4/10.0.0.1/tcp/4001",
+		"/ip4/10.0.0.2/tcp/4001",
+		"/ip4/10.0.0.1",
+		"/ip4/10.0.0.2",
+	}
+
+	for i := 0; i < 10; i++ {
+		a, err := NewAnnouncer(NetworkConfig{AnnounceOverrides: overrides})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]string, 0, len(a.overrides))
+		for _, o := range a.overrides {
+			got = append(got, o.key)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func parseTestAddrs(t *testing.T, addrs []string) []ma.Multiaddr {
+	t.Helper()
+
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+	return maddrs
+}
+
+// testResolver signals each resolution on calls, and resolves addresses
+// while resolves is set.
+type testResolver struct {
+	calls    chan struct{}
+	resolves atomic.Bool
+}
+
+func (r *testResolver) Resolve(ctx context.Context, maddr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	resolves := r.resolves.Load()
+
+	select {
+	case r.calls <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if !resolves {
+		return nil, errors.New("no such host")
+	}
+	return []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}, nil
+}
+
+func TestAnnouncerRecheckDNS(t *testing.T) {
+	announce := []string{"/dns4/relay.example.com/tcp/4001", "/ip4/5.6.7.8/tcp/4001"}
+	a, err := NewAnnouncer(NetworkConfig{AnnounceAddrs: announce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewMock()
+	a.clock = clk
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &testResolver{calls: make(chan struct{})}
+	r.resolves.Store(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.RecheckDNS(ctx, r, time.Minute)
+	}()
+
+	// a resolution completes once the next one starts; as the outcome of a
+	// resolution is decided when it starts, the one in flight when the stub
+	// is toggled keeps the previous outcome
+	<-r.calls
+	recheck := func() {
+		t.Helper()
+		clk.Add(time.Minute)
+		<-r.calls
+	}
+
+	recheck()
+	if got := a.Addrs(nil); len(got) != 2 {
+		t.Fatalf("got %v, want both announce addresses", got)
+	}
+
+	r.resolves.Store(false)
+	recheck()
+	for i := 0; i < dnsFailureGrace-1; i++ {
+		recheck()
+		if got := a.Addrs(nil); len(got) != 2 {
+			t.Fatalf("got %v within the failure grace, want both announce addresses", got)
+		}
+	}
+	recheck()
+	want := parseTestAddrs(t, announce[1:])
+	if got := a.Addrs(nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v after the failure grace, want %v", got, want)
+	}
+
+	r.resolves.Store(true)
+	recheck()
+	recheck()
+	if got := a.Addrs(nil); len(got) != 2 {
+		t.Fatalf("got %v once resolving again, want both announce addresses", got)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestListen(t *testing.T) {
+	// hold a port, so that listening on it fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	taken := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", l.Addr().(*net.TCPAddr).Port)
+
+	for _, tc := range []struct {
+		name    string
+		cfg     NetworkConfig
+		wantErr bool
+		listen  int
+	}{
+		{name: "port taken", cfg: NetworkConfig{ListenAddrs: []string{taken}}, wantErr: true},
+		{name: "allow no listen", cfg: NetworkConfig{ListenAddrs: []string{taken}, AllowNoListen: true}},
+		{name: "any address binds", cfg: NetworkConfig{ListenAddrs: []string{taken, "/ip4/127.0.0.1/tcp/0"}}, listen: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := libp2p.New(libp2p.NoListenAddrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			err = Listen(h, tc.cfg)
+			if tc.wantErr {
+				if !errors.Is(err, ErrNoListenAddr) {
+					t.Fatalf("got error %v, want %v", err, ErrNoListenAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(h.Network().ListenAddresses()); got != tc.listen {
+				t.Fatalf("listening on %d addresses, want %d", got, tc.listen)
+			}
+		})
+	}
+
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := Listen(h, NetworkConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp"}}); err == nil || errors.Is(err, ErrNoListenAddr) {
+		t.Fatalf("got error %v, want a parse error", err)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries atomic.Int32
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		for _, q := range req.Question {
+			if q.Name == "relay.example.com." && q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("10.1.2.3"),
+				})
+			}
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	resolver, err := NewResolver(NetworkConfig{DNSResolver: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := resolver.Resolve(ctx, ma.StringCast("/dns4/relay.example.com/tcp/4001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ma.Multiaddr{ma.StringCast("/ip4/10.1.2.3/tcp/4001")}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("resolved %v, want %v", addrs, want)
+	}
+	if queries.Load() == 0 {
+		t.Fatal("configured resolver not queried")
+	}
+
+	if _, err := NewResolver(NetworkConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+package relaydaemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// Admin serves the relay daemon administration HTTP API.
+type Admin struct {
+	cfg      Config
+	host     host.Host
+	acl      *ACLFilter
+	limiter  *Limiter
+	shutdown *Shutdown
+	audit    *AuditLog
+	mux      *http.ServeMux
+}
+
+var _ http.Handler = (*Admin)(nil)
+
+// NewAdmin returns the administration HTTP API handler for the given host,
+// ACL, resource manager limiter and shutdown signal, using the relay
+// config. Mutating actions require the admin token of the config, and are
+// recorded in the given audit log, which may be nil.
+func NewAdmin(cfg Config, h host.Host, acl *ACLFilter, limiter *Limiter, shutdown *Shutdown, audit *AuditLog) *Admin {
+	a := &Admin{
+		cfg:      cfg,
+		host:     h,
+		acl:      acl,
+		limiter:  limiter,
+		shutdown: shutdown,
+		audit:    audit,
+		mux:      http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/admin/acl/profile", a.mutating("acl_profile", a.handleACLProfile))
+	a.mux.HandleFunc("/admin/capabilities", a.handleCapabilities)
+	a.mux.HandleFunc("/admin/drain", a.mutating("drain", a.handleDrain))
+	a.mux.HandleFunc("/admin/peer-record", a.handlePeerRecord)
+	a.mux.HandleFunc("/admin/rcmgr", a.handleLimitsStatus)
+	a.mux.HandleFunc("/admin/rcmgr/reload", a.mutating("rcmgr_reload", a.handleLimitsReload))
+	a.mux.HandleFunc("/admin/shutdown", a.mutating("shutdown", a.handleShutdown))
+
+	return a
+}
+
+// ServeHTTP implements http.Handler.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// mutating wraps the handler of a mutating admin API action, which is
+// authorized and audited.
+func (a *Admin) mutating(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return a.audited(action, a.authorized(handler))
+}
+
+// authorized wraps the given admin API handler, requiring the request to
+// carry the configured admin token as a bearer token. Without an admin
+// token, all requests are forbidden.
+func (a *Admin) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.Daemon.AdminToken == "" {
+			http.Error(w, "mutating admin actions are disabled without an admin token", http.StatusForbidden)
+			return
+		}
+
+		token := bearerToken(r)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Daemon.AdminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// bearerToken returns the bearer token of the Authorization header of the
+// given request, or the empty string if there is none.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// handleACLProfile activates the ACL profile named by the name query parameter.
+func (a *Admin) handleACLProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if err := a.acl.SetProfile(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "ACL profile %s is active\n", name)
+}
+
+// handleCapabilities responds with the capabilities of the relay.
+func (a *Admin) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RelayCapabilities(a.host, a.cfg, a.acl))
+}
+
+// handleDrain enables or disables drain mode according to the enabled query
+// parameter.
+func (a *Admin) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	a.acl.SetDraining(enabled)
+	fmt.Fprintf(w, "draining: %t\n", enabled)
+}
+
+// handlePeerRecord responds with the signed peer record of the relay.
+func (a *Admin) handlePeerRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rec, err := SignedPeerRecord(a.host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// handleLimitsStatus responds with the resource manager usage against its
+// limits.
+func (a *Admin) handleLimitsStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := a.limiter.Status(a.host.Network().ResourceManager())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleLimitsReload reloads the resource manager limits and responds with
+// the report of how they were applied.
+func (a *Admin) handleLimitsReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := a.limiter.Reload(a.host.Network().ResourceManager())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleShutdown triggers a graceful shutdown, if remote shutdown is allowed
+// and the token form value matches the configured shutdown token.
+func (a *Admin) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.cfg.Daemon.AllowRemoteShutdown || a.cfg.Daemon.ShutdownToken == "" {
+		http.Error(w, "remote shutdown is disabled", http.StatusForbidden)
+		return
+	}
+
+	token := r.FormValue("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Daemon.ShutdownToken)) != 1 {
+		http.Error(w, "invalid shutdown token", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "shutting down\n")
+	a.shutdown.Request()
+}
+
+// NewHTTPServer returns an HTTP server for the given address and handler,
+// using the read and write timeouts of the given daemon config.
+func NewHTTPServer(cfg DaemonConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.HTTPReadTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+	}
+}
+
+// LimitListener returns a listener accepting at most max simultaneous
+// connections from the given listener; connections beyond the limit are
+// answered with 503 Service Unavailable and closed.
+func LimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, max),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			go rejectConn(c)
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func rejectConn(c net.Conn) {
+	defer c.Close()
+
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(c, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+}
@@ -0,0 +1,352 @@
+package relaydaemon
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/record"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestAdminShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		daemon     DaemonConfig
+		adminToken string
+		token      string
+		want       int
+	}{
+		{
+			name:       "correct tokens",
+			daemon:     DaemonConfig{AdminToken: "admin", AllowRemoteShutdown: true, ShutdownToken: "confirm"},
+			adminToken: "admin",
+			token:      "confirm",
+			want:       http.StatusAccepted,
+		},
+		{
+			name:       "wrong shutdown token",
+			daemon:     DaemonConfig{AdminToken: "admin", AllowRemoteShutdown: true, ShutdownToken: "confirm"},
+			adminToken: "admin",
+			token:      "wrong",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "wrong admin token",
+			daemon:     DaemonConfig{AdminToken: "admin", AllowRemoteShutdown: true, ShutdownToken: "confirm"},
+			adminToken: "wrong",
+			token:      "confirm",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:   "no admin token",
+			daemon: DaemonConfig{AllowRemoteShutdown: true, ShutdownToken: "confirm"},
+			token:  "confirm",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:       "remote shutdown disabled",
+			daemon:     DaemonConfig{AdminToken: "admin", ShutdownToken: "confirm"},
+			adminToken: "admin",
+			token:      "confirm",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "no shutdown token",
+			daemon:     DaemonConfig{AdminToken: "admin", AllowRemoteShutdown: true},
+			adminToken: "admin",
+			want:       http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shutdown := NewShutdown()
+			a := NewAdmin(Config{Daemon: tc.daemon}, nil, nil, nil, shutdown, nil)
+
+			form := url.Values{"token": {tc.token}}
+			r := httptest.NewRequest(http.MethodPost, "/admin/shutdown", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.adminToken != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.adminToken)
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != tc.want {
+				t.Fatalf("got status %d, want %d", w.Code, tc.want)
+			}
+
+			select {
+			case <-shutdown.Done():
+				if tc.want != http.StatusAccepted {
+					t.Fatal("shutdown triggered by a rejected request")
+				}
+			default:
+				if tc.want == http.StatusAccepted {
+					t.Fatal("shutdown not triggered")
+				}
+			}
+		})
+	}
+}
+
+func TestAdminMutatingEndpointsRequireToken(t *testing.T) {
+	a := NewAdmin(Config{Daemon: DaemonConfig{AdminToken: "admin"}}, nil, nil, nil, NewShutdown(), nil)
+
+	for _, path := range []string{
+		"/admin/acl/profile?name=default",
+		"/admin/drain?enabled=true",
+		"/admin/rcmgr/reload",
+		"/admin/shutdown",
+	} {
+		for _, header := range []string{"", "Bearer wrong", "admin"} {
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s with authorization %q: got status %d, want %d", path, header, w.Code, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+// testResourceManager is a resource manager with a fixed usage snapshot.
+type testResourceManager struct {
+	network.ResourceManager
+
+	stat rcmgr.ResourceManagerStat
+}
+
+func (rm *testResourceManager) ListServices() []string          { return nil }
+func (rm *testResourceManager) ListProtocols() []protocol.ID    { return nil }
+func (rm *testResourceManager) ListPeers() []peer.ID            { return nil }
+func (rm *testResourceManager) Stat() rcmgr.ResourceManagerStat { return rm.stat }
+
+func TestAdminLimitsStatus(t *testing.T) {
+	limiter, err := NewLimiter(DaemonConfig{RelayMemoryLimit: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHost()
+	h.net.rm = &testResourceManager{stat: rcmgr.ResourceManagerStat{
+		System:    network.ScopeStat{NumConnsInbound: 10, NumStreamsInbound: 20, Memory: 1 << 20, NumFD: 5},
+		Transient: network.ScopeStat{NumConnsInbound: 1},
+		Services: map[string]network.ScopeStat{
+			relayv2.ServiceName: {NumStreamsInbound: 4, Memory: 4096},
+		},
+	}}
+	a := NewAdmin(Config{}, h, nil, limiter, NewShutdown(), nil)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/rcmgr", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var status ResourceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.System.Usage.NumConnsInbound != 10 || status.System.Usage.Memory != 1<<20 || status.System.Usage.NumFD != 5 {
+		t.Errorf("system usage: %+v", status.System.Usage)
+	}
+	if want := baseLimit(limiter.GetSystemLimits()); status.System.Limit != want {
+		t.Errorf("system limit: got %+v, want %+v", status.System.Limit, want)
+	}
+	if status.Transient.Usage.NumConnsInbound != 1 {
+		t.Errorf("transient usage: %+v", status.Transient.Usage)
+	}
+	relay, ok := status.Services[relayv2.ServiceName]
+	if !ok {
+		t.Fatalf("relay service missing: %+v", status.Services)
+	}
+	if relay.Usage.NumStreamsInbound != 4 || relay.Limit.Memory != 64<<20 {
+		t.Errorf("relay service: %+v", relay)
+	}
+
+	// only GET is allowed
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/rcmgr", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminPeerRecord(t *testing.T) {
+	h := newLoopbackHost(t)
+	a := NewAdmin(Config{}, h, nil, nil, NewShutdown(), nil)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/peer-record", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var info PeerRecordInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.PeerID != h.ID() {
+		t.Errorf("peer ID %s, want %s", info.PeerID, h.ID())
+	}
+
+	// the envelope is signed by the relay and holds the decoded record
+	data, err := base64.StdEncoding.DecodeString(info.Envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, r, err := record.ConsumeEnvelope(data, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != h.ID() {
+		t.Errorf("envelope signed by %s, want %s", signer, h.ID())
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		t.Fatalf("unexpected record type %T", r)
+	}
+	if rec.PeerID != h.ID() || rec.Seq != info.Seq {
+		t.Errorf("record of %s with seq %d, want %s with seq %d", rec.PeerID, rec.Seq, h.ID(), info.Seq)
+	}
+	var addrs []string
+	for _, addr := range rec.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	if strings.Join(addrs, " ") != strings.Join(info.Addrs, " ") {
+		t.Errorf("addresses %v, want the record addresses %v", info.Addrs, addrs)
+	}
+	for _, addr := range h.Addrs() {
+		if !strings.Contains(strings.Join(info.Addrs, " "), addr.String()) {
+			t.Errorf("listen address %s missing from %v", addr, info.Addrs)
+		}
+	}
+
+	// only GET is allowed
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/peer-record", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewHTTPServer(DaemonConfig{HTTPReadTimeout: 100 * time.Millisecond, HTTPWriteTimeout: time.Second}, l.Addr().String(), http.NotFoundHandler())
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// a slow client never completes its request headers
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("connection not closed by the server: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("connection closed after %s", elapsed)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+	})}
+	go srv.Serve(LimitListener(l, 1))
+	defer srv.Close()
+
+	request := func(path string) (net.Conn, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		return c, err
+	}
+	status := func(c net.Conn) int {
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	blocked, err := request("/block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocked.Close()
+	<-entered
+
+	// beyond the limit
+	c, err := request("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(c); got != http.StatusServiceUnavailable {
+		t.Fatalf("status %d beyond the limit, want %d", got, http.StatusServiceUnavailable)
+	}
+	c.Close()
+
+	// the slot is released once the connection is closed
+	close(release)
+	if got := status(blocked); got != http.StatusOK {
+		t.Fatalf("status %d, want %d", got, http.StatusOK)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c, err := request("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := status(c)
+		c.Close()
+		if got == http.StatusOK {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("status %d after the slot is released", got)
+		}
+	}
+}
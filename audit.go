@@ -0,0 +1,134 @@
+package relaydaemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a record of a mutating admin API action.
+type AuditRecord struct {
+	Time      time.Time         `json:"time"`
+	Principal string            `json:"principal"`
+	Remote    string            `json:"remote"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params,omitempty"`
+	Status    int               `json:"status"`
+}
+
+// AuditLog appends audit records as JSON lines to a file.
+type AuditLog struct {
+	mx sync.Mutex
+	f  *os.File
+}
+
+// OpenAuditLog opens the audit log at the given path for appending, creating
+// it if necessary. An empty path returns a nil audit log, which discards all
+// records.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{f: f}, nil
+}
+
+// Record appends the given record to the audit log and syncs it to disk.
+func (l *AuditLog) Record(rec AuditRecord) error {
+	if l == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if _, err := l.f.Write(b); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Close closes the audit log.
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// audited wraps the given admin API handler, recording the action in the
+// audit log along with its request parameters and response status. The
+// principal identifies the admin token presented by the request, if any, so
+// that rejected requests are told apart too.
+func (a *Admin) audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+
+		rec := AuditRecord{
+			Time:      time.Now().UTC(),
+			Principal: auditPrincipal(bearerToken(r)),
+			Remote:    r.RemoteAddr,
+			Action:    action,
+			Status:    sw.status,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			rec.Remote = host
+		}
+		for k, v := range r.Form {
+			// never log the shutdown token
+			if k == "token" || len(v) == 0 {
+				continue
+			}
+			if rec.Params == nil {
+				rec.Params = make(map[string]string)
+			}
+			rec.Params[k] = v[0]
+		}
+
+		if err := a.audit.Record(rec); err != nil {
+			fmt.Printf("error writing audit record: %s\n", err)
+		}
+	}
+}
+
+// auditPrincipal returns the audit principal of a request presenting the
+// given token: a prefix of the token hash, which tells tokens apart without
+// revealing them, or "anonymous" without a token.
+func auditPrincipal(token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+
+	h := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(h[:8])
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,121 @@
+package relaydaemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditPrincipal(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header string
+		want   string
+	}{
+		{name: "no token", query: "name=default", want: "anonymous"},
+		{name: "admin token", query: "name=default", header: "Bearer secret", want: auditPrincipal("secret")},
+		{name: "shutdown token", query: "token=secret", want: "anonymous"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			audit, err := OpenAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer audit.Close()
+
+			a := &Admin{audit: audit}
+			handler := a.audited("test", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/admin/test?"+tc.query, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			handler(httptest.NewRecorder(), r)
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(b), "secret") {
+				t.Fatalf("token logged: %s", b)
+			}
+
+			var rec AuditRecord
+			if err := json.Unmarshal(b, &rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Principal != tc.want {
+				t.Errorf("principal %q, want %q", rec.Principal, tc.want)
+			}
+			if rec.Remote != "127.0.0.1" || rec.Action != "test" || rec.Status != http.StatusAccepted {
+				t.Errorf("unexpected record: %+v", rec)
+			}
+		})
+	}
+
+	if auditPrincipal("a") == auditPrincipal("b") {
+		t.Error("distinct tokens share a principal")
+	}
+}
+
+func TestAuditDrain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	h := newTestHost()
+	acl, err := NewACL(h, ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAdmin(Config{Daemon: DaemonConfig{AdminToken: "admin"}}, h, acl, nil, NewShutdown(), audit)
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/drain?enabled=true", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if !acl.draining.Load() {
+		t.Fatal("not draining")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Time.Before(start.Add(-time.Second)) || rec.Time.After(time.Now()) {
+		t.Errorf("record time %s, want about %s", rec.Time, start)
+	}
+	rec.Time = time.Time{}
+	want := AuditRecord{
+		Principal: auditPrincipal("admin"),
+		Remote:    "127.0.0.1",
+		Action:    "drain",
+		Params:    map[string]string{"enabled": "true"},
+		Status:    http.StatusOK,
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("record %+v, want %+v", rec, want)
+	}
+}
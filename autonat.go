@@ -0,0 +1,64 @@
+package relaydaemon
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/host/autonat"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+)
+
+// NewNATService starts an AutoNAT service on the given host, whose dial-backs
+// only use the given transports ("tcp", "quic", "websocket" or
+// "webtransport"). The dial-backs are made from a separate dialer host, using
+// the given private network key if it is not nil.
+func NewNATService(h host.Host, transports []string, psk pnet.PSK) (autonat.AutoNAT, error) {
+	dialer, err := newNATDialer(transports, psk)
+	if err != nil {
+		return nil, err
+	}
+
+	return autonat.New(h,
+		autonat.EnableService(dialer.Network()),
+		autonat.WithReachability(network.ReachabilityPublic),
+	)
+}
+
+// newNATDialer returns a host without listen addresses that only dials with
+// the given transports.
+func newNATDialer(transports []string, psk pnet.PSK) (host.Host, error) {
+	opts := []libp2p.Option{
+		libp2p.NoListenAddrs,
+		libp2p.DisableRelay(),
+	}
+	if psk != nil {
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+
+	for _, t := range transports {
+		switch t {
+		case "tcp":
+			opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+		case "quic":
+			opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+		case "websocket":
+			opts = append(opts, libp2p.Transport(websocket.New))
+		case "webtransport":
+			opts = append(opts, libp2p.Transport(webtransport.New))
+		default:
+			return nil, fmt.Errorf("unknown AutoNAT dial transport: %s", t)
+		}
+	}
+
+	dialer, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AutoNAT dialer: %w", err)
+	}
+	return dialer, nil
+}
@@ -0,0 +1,49 @@
+package relaydaemon
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestNATDialerTransports(t *testing.T) {
+	addrs := map[string]ma.Multiaddr{
+		"tcp":          ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		"quic":         ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1"),
+		"websocket":    ma.StringCast("/ip4/1.2.3.4/tcp/4002/ws"),
+		"webtransport": ma.StringCast("/ip4/1.2.3.4/udp/4002/quic-v1/webtransport"),
+	}
+
+	for _, tc := range []struct {
+		name       string
+		transports []string
+	}{
+		{name: "tcp only", transports: []string{"tcp"}},
+		{name: "quic only", transports: []string{"quic"}},
+		{name: "tcp and websocket", transports: []string{"tcp", "websocket"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer, err := newNATDialer(tc.transports, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dialer.Close()
+
+			enabled := make(map[string]bool)
+			for _, tpt := range tc.transports {
+				enabled[tpt] = true
+			}
+			sw := dialer.Network().(*swarm.Swarm)
+			for tpt, addr := range addrs {
+				if got := sw.TransportForDialing(addr) != nil; got != enabled[tpt] {
+					t.Errorf("%s dialing %t, want %t", tpt, got, enabled[tpt])
+				}
+			}
+		})
+	}
+
+	if _, err := newNATDialer([]string{"udp"}, nil); err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+}
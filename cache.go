@@ -0,0 +1,113 @@
+package relaydaemon
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// decisionKey identifies a cached ACL decision.
+type decisionKey struct {
+	peer peer.ID
+	op   string
+	ip   string
+}
+
+type decision struct {
+	key     decisionKey
+	allow   bool
+	expires time.Time
+}
+
+// decisionCache is an LRU cache of ACL decisions, which expire after a TTL.
+// A cache belongs to a set of ACL rules, so that replacing the rules
+// invalidates it.
+type decisionCache struct {
+	clock clock.Clock
+	size  int
+	ttl   time.Duration
+
+	mx      sync.Mutex
+	lru     *list.List
+	entries map[decisionKey]*list.Element
+}
+
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		clock:   clock.New(),
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[decisionKey]*list.Element, size),
+	}
+}
+
+// get returns the cached decision for the given key, if any.
+func (c *decisionCache) get(key decisionKey) (allow, ok bool) {
+	if c == nil {
+		return false, false
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	d := e.Value.(*decision)
+	if c.clock.Now().After(d.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return false, false
+	}
+
+	c.lru.MoveToFront(e)
+	return d.allow, true
+}
+
+// put caches the decision for the given key, evicting the least recently
+// used decision if the cache is full.
+func (c *decisionCache) put(key decisionKey, allow bool) {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		d := e.Value.(*decision)
+		d.allow = allow
+		d.expires = c.clock.Now().Add(c.ttl)
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decision).key)
+	}
+	c.entries[key] = c.lru.PushFront(&decision{
+		key:     key,
+		allow:   allow,
+		expires: c.clock.Now().Add(c.ttl),
+	})
+}
+
+// clear drops all cached decisions.
+func (c *decisionCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[decisionKey]*list.Element, c.size)
+}
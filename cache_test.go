@@ -0,0 +1,159 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDecisionCache(t *testing.T) {
+	const ttl = time.Minute
+	key := func(i int) decisionKey {
+		return decisionKey{peer: peer.ID(fmt.Sprintf("peer-%d", i)), op: "reserve", ip: "1.2.3.4"}
+	}
+
+	for _, tc := range []struct {
+		name string
+		run  func(c *decisionCache, clk *clock.Mock)
+		// keys expected to be cached afterwards, with their decisions
+		want map[int]bool
+	}{
+		{
+			name: "cached decisions",
+			run: func(c *decisionCache, clk *clock.Mock) {
+				c.put(key(0), true)
+				c.put(key(1), false)
+			},
+			want: map[int]bool{0: true, 1: false},
+		},
+		{
+			name: "least recently used is evicted",
+			run: func(c *decisionCache, clk *clock.Mock) {
+				c.put(key(0), true)
+				c.put(key(1), true)
+				c.get(key(0))
+				c.put(key(2), true)
+			},
+			want: map[int]bool{0: true, 2: true},
+		},
+		{
+			name: "decisions expire",
+			run: func(c *decisionCache, clk *clock.Mock) {
+				c.put(key(0), true)
+				clk.Add(ttl / 2)
+				c.put(key(1), true)
+				clk.Add(ttl/2 + time.Second)
+			},
+			want: map[int]bool{1: true},
+		},
+		{
+			name: "updates refresh the TTL",
+			run: func(c *decisionCache, clk *clock.Mock) {
+				c.put(key(0), true)
+				clk.Add(ttl / 2)
+				c.put(key(0), false)
+				clk.Add(ttl/2 + time.Second)
+			},
+			want: map[int]bool{0: false},
+		},
+		{
+			name: "clear",
+			run: func(c *decisionCache, clk *clock.Mock) {
+				c.put(key(0), true)
+				c.clear()
+			},
+			want: map[int]bool{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := clock.NewMock()
+			c := newDecisionCache(2, ttl)
+			c.clock = clk
+
+			tc.run(c, clk)
+
+			for i := 0; i < 3; i++ {
+				allow, ok := c.get(key(i))
+				want, wantOK := tc.want[i]
+				if ok != wantOK || allow != want {
+					t.Errorf("key %d: got %t, %t, want %t, %t", i, allow, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionCacheNil(t *testing.T) {
+	var c *decisionCache
+	c.put(decisionKey{}, true)
+	if _, ok := c.get(decisionKey{}); ok {
+		t.Fatal("disabled cache returned a decision")
+	}
+}
+
+func TestACLDecisionCacheInvalidation(t *testing.T) {
+	p := peer.ID("peer")
+	addr := ma.StringCast("/ip4/10.1.2.3/tcp/4001")
+
+	acl, err := NewACL(newTestHost(), ACLConfig{
+		AllowSubnets:      []string{"10.0.0.0/8"},
+		DecisionCacheSize: 16,
+		DecisionCacheTTL:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !acl.AllowReserve(p, addr) {
+		t.Fatal("reservation from an allowed subnet denied")
+	}
+	if _, ok := acl.rules.Load().cache.get(decisionKey{peer: p, op: "reserve", ip: "10.1.2.3"}); !ok {
+		t.Fatal("decision not cached")
+	}
+
+	// reloading the rules drops the cached decisions
+	err = acl.Update(ACLConfig{
+		AllowSubnets:      []string{"192.168.0.0/16"},
+		DecisionCacheSize: 16,
+		DecisionCacheTTL:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.AllowReserve(p, addr) {
+		t.Fatal("cached decision used after reload")
+	}
+}
+
+// BenchmarkACLAllowReserve compares reservation decisions against a large
+// subnet list with and without the decision cache.
+func BenchmarkACLAllowReserve(b *testing.B) {
+	subnets := make([]string, 0, 4096)
+	for i := 0; i < cap(subnets); i++ {
+		subnets = append(subnets, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+	addr := ma.StringCast("/ip4/192.168.1.1/tcp/4001")
+
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			acl, err := NewACL(newTestHost(), ACLConfig{
+				AllowSubnets:      subnets,
+				DecisionCacheSize: size,
+				DecisionCacheTTL:  time.Hour,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			rules := acl.rules.Load()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				acl.allowReserve(rules, peer.ID("peer"), addr)
+			}
+		})
+	}
+}
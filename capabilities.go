@@ -0,0 +1,78 @@
+package relaydaemon
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// relayProtocolPrefix is the prefix of the relay protocol IDs.
+const relayProtocolPrefix = "/libp2p/circuit/relay/"
+
+// Capabilities describes what the relay offers, for directory services and
+// clients choosing a relay.
+type Capabilities struct {
+	PeerID     peer.ID  `json:"peer_id"`
+	Transports []string `json:"transports"`
+	Protocols  []string `json:"protocols"`
+
+	MaxReservations        int           `json:"max_reservations"`
+	MaxReservationsPerPeer int           `json:"max_reservations_per_peer"`
+	MaxReservationsPerIP   int           `json:"max_reservations_per_ip"`
+	MaxCircuits            int           `json:"max_circuits"`
+	ReservationTTL         time.Duration `json:"reservation_ttl"`
+	LimitDuration          time.Duration `json:"limit_duration,omitempty"`
+	LimitData              int64         `json:"limit_data,omitempty"`
+
+	// whether any peer may reserve, or the ACL restricts reservations
+	Open     bool `json:"open"`
+	Draining bool `json:"draining"`
+}
+
+// RelayCapabilities returns the capabilities of the relay running on the
+// given host with the given config and ACL. The transports and protocols are
+// those the host actually listens on and serves; durations are in
+// nanoseconds.
+func RelayCapabilities(h host.Host, cfg Config, acl *ACLFilter) Capabilities {
+	c := Capabilities{
+		PeerID:     h.ID(),
+		Transports: []string{},
+		Protocols:  []string{},
+		Open:       acl.Open(),
+		Draining:   acl.draining.Load(),
+	}
+
+	transports := make(map[string]struct{})
+	for _, addr := range h.Network().ListenAddresses() {
+		transports[addrTransport(addr)] = struct{}{}
+	}
+	for t := range transports {
+		c.Transports = append(c.Transports, t)
+	}
+	sort.Strings(c.Transports)
+
+	for _, proto := range h.Mux().Protocols() {
+		if strings.HasPrefix(string(proto), relayProtocolPrefix) {
+			c.Protocols = append(c.Protocols, string(proto))
+		}
+	}
+	sort.Strings(c.Protocols)
+
+	if cfg.RelayV2.Enabled {
+		res := cfg.RelayV2.Resources
+		c.MaxReservations = res.MaxReservations
+		c.MaxReservationsPerPeer = res.MaxReservationsPerPeer
+		c.MaxReservationsPerIP = res.MaxReservationsPerIP
+		c.MaxCircuits = res.MaxCircuits
+		c.ReservationTTL = res.ReservationTTL
+		if res.Limit != nil {
+			c.LimitDuration = res.Limit.Duration
+			c.LimitData = res.Limit.Data
+		}
+	}
+
+	return c
+}
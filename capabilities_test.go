@@ -0,0 +1,98 @@
+package relaydaemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestAdminCapabilities(t *testing.T) {
+	// as in the daemon, the host serves the relay but is not a relay client
+	h, err := libp2p.New(
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"),
+		libp2p.DisableRelay(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	res := relayv2.DefaultResources()
+	res.MaxReservations = 64
+	res.MaxCircuits = 8
+	res.ReservationTTL = 30 * time.Minute
+	res.Limit = &relayv2.RelayLimit{Duration: time.Minute, Data: 1 << 16}
+	r, err := relayv2.New(h, relayv2.WithResources(res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	capabilities := func(t *testing.T, cfg Config, acl *ACLFilter) Capabilities {
+		t.Helper()
+
+		a := NewAdmin(cfg, h, acl, nil, NewShutdown(), nil)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/capabilities", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		var c Capabilities
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	t.Run("open", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.RelayV2.Resources = res
+		acl, err := NewACL(h, ACLConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := Capabilities{
+			PeerID:                 h.ID(),
+			Transports:             []string{"quic", "tcp"},
+			Protocols:              []string{"/libp2p/circuit/relay/0.2.0/hop"},
+			MaxReservations:        64,
+			MaxReservationsPerPeer: res.MaxReservationsPerPeer,
+			MaxReservationsPerIP:   res.MaxReservationsPerIP,
+			MaxCircuits:            8,
+			ReservationTTL:         30 * time.Minute,
+			LimitDuration:          time.Minute,
+			LimitData:              1 << 16,
+			Open:                   true,
+		}
+		if c := capabilities(t, cfg, acl); !reflect.DeepEqual(c, want) {
+			t.Fatalf("capabilities %+v, want %+v", c, want)
+		}
+	})
+
+	t.Run("restricted and draining", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.RelayV2.Enabled = false
+		acl, err := NewACL(h, ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl.draining.Store(true)
+
+		want := Capabilities{
+			PeerID:     h.ID(),
+			Transports: []string{"quic", "tcp"},
+			Protocols:  []string{"/libp2p/circuit/relay/0.2.0/hop"},
+			Draining:   true,
+		}
+		if c := capabilities(t, cfg, acl); !reflect.DeepEqual(c, want) {
+			t.Fatalf("capabilities %+v, want %+v", c, want)
+		}
+	})
+}
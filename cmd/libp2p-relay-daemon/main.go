@@ -7,19 +7,26 @@ import (
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	relaydaemon "github.com/libp2p/go-libp2p-relay-daemon"
+	coreconnmgr "github.com/libp2p/go-libp2p/core/connmgr"
 	libp2phost "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/libp2p/go-libp2p/core/routing"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
 	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
-	ma "github.com/multiformats/go-multiaddr"
-	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
 )
@@ -28,19 +35,38 @@ import (
 const (
 	NameID     = "id"
 	NameConfig = "config"
+	NameCfgDir = "config-dir"
 	NamePSK    = "swarmkey"
+	NameProbe  = "test-relay"
 )
 
 func main() {
 	idPath := flag.String(NameID, "identity", "identity key file path")
 	cfgPath := flag.String(NameConfig, "", "json configuration file; empty uses the default configuration")
+	cfgDir := flag.String(NameCfgDir, "", "directory of json/yaml configuration fragments, merged in lexical order over the configuration")
 	pskPath := flag.String(NamePSK, "", "file path to a multicodec-encoded v1 private swarm key")
+	probeAddr := flag.String(NameProbe, "", "relay multiaddr to test by connecting to the target peer given as argument through it, then exit")
 	flag.Parse()
 
+	if *probeAddr != "" {
+		probeRelay(*probeAddr, flag.Arg(0), *pskPath)
+		return
+	}
+
 	cfg, err := relaydaemon.LoadConfig(*cfgPath)
 	if err != nil {
 		panic(err)
 	}
+	if *cfgDir != "" {
+		err = relaydaemon.MergeConfigDir(&cfg, *cfgDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+	relaydaemon.SetQuiet(cfg.Daemon.Quiet)
 	privk, err := relaydaemon.LoadIdentity(*idPath)
 	if err != nil {
 		panic(err)
@@ -49,19 +75,29 @@ func main() {
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		http.Handle("/debug/metrics/prometheus", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Daemon.PromPort), nil))
+		log.Fatal(relaydaemon.NewHTTPServer(cfg.Daemon, fmt.Sprintf(":%d", cfg.Daemon.PromPort), nil).ListenAndServe())
 	}()
 
 	rcmgr.MustRegisterWith(prometheus.DefaultRegisterer)
+	relaydaemon.MustRegisterWith(prometheus.DefaultRegisterer)
+	relaydaemon.SetMaxMetricSeries(cfg.Daemon.MaxMetricSeries)
+	relaydaemon.StartMetricsWarmup(cfg.Daemon.MetricsWarmup)
+	relaydaemon.SetConnMgrWatermarks(cfg.ConnMgr)
 
 	str, err := rcmgr.NewStatsTraceReporter()
 	if err != nil {
 		log.Fatal(err)
 	}
-	rmgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(rcmgr.DefaultLimits.AutoScale()), rcmgr.WithTraceReporter(str))
+	limiter, err := relaydaemon.NewLimiter(cfg.Daemon)
 	if err != nil {
 		log.Fatal(err)
 	}
+	rmgr, err := rcmgr.NewResourceManager(limiter, rcmgr.WithTraceReporter(str), rcmgr.WithTraceReporter(relaydaemon.StreamRejections{}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gater := relaydaemon.NewConnGater(cfg.Network)
 
 	var opts []libp2p.Option
 
@@ -69,10 +105,11 @@ func main() {
 		libp2p.Identity(privk),
 		libp2p.UserAgent("relayd/1.0"),
 		libp2p.DisableRelay(),
-		libp2p.ListenAddrStrings(cfg.Network.ListenAddrs...),
+		// listen addresses are bound once the host is constructed
+		libp2p.NoListenAddrs,
 		libp2p.ResourceManager(rmgr),
+		libp2p.ConnectionGater(gater),
 		libp2p.ForceReachabilityPublic(),
-		libp2p.EnableNATService(),
 		// support TLS connections
 		libp2p.Security(libp2ptls.ID, libp2ptls.New),
 		// support noise connections
@@ -81,110 +118,365 @@ func main() {
 		libp2p.DefaultTransports,
 	)
 
+	// AutoNAT dial-backs are restricted to specific transports by running the
+	// service with a separate dialer once the host is constructed.
+	if len(cfg.Network.AutoNATDialTransports) == 0 {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+
 	// load PSK if applicable
+	var psk pnet.PSK
 	if pskPath != nil {
-		psk, fprint, err := relaydaemon.LoadSwarmKey(*pskPath)
+		var fprint relaydaemon.PNetFingerprint
+		psk, fprint, err = relaydaemon.SelectSwarmKey(*pskPath, cfg.Network)
 		if err != nil {
 			fmt.Printf("error loading swarm key: %s\n", err.Error())
 		}
 		if psk != nil {
-			fmt.Printf("PSK detected, private identity: %x\n", fprint)
+			relaydaemon.Infof("PSK detected, private identity: %x\n", fprint)
 			opts = append(opts, libp2p.PrivateNetwork(psk))
 		}
 	}
 
-	if len(cfg.Network.AnnounceAddrs) > 0 {
-		var announce []ma.Multiaddr
-		for _, s := range cfg.Network.AnnounceAddrs {
-			a := ma.StringCast(s)
-			announce = append(announce, a)
-		}
-		opts = append(opts,
-			libp2p.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
-				return announce
-			}),
-		)
+	resolver, err := relaydaemon.NewResolver(cfg.Network)
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, libp2p.MultiaddrResolver(resolver))
+
+	announcer, err := relaydaemon.NewAnnouncer(cfg.Network)
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, libp2p.AddrsFactory(announcer.Addrs))
+
+	var cm coreconnmgr.ConnManager
+	if cfg.ConnMgr.Disabled {
+		cm = relaydaemon.NewTagConnMgr()
 	} else {
-		opts = append(opts,
-			libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
-				announce := make([]ma.Multiaddr, 0, len(addrs))
-				for _, a := range addrs {
-					if manet.IsPublicAddr(a) {
-						announce = append(announce, a)
-					}
-				}
-				return announce
-			}),
+		cm, err = connmgr.NewConnManager(
+			cfg.ConnMgr.ConnMgrLo,
+			cfg.ConnMgr.ConnMgrHi,
+			connmgr.WithGracePeriod(cfg.ConnMgr.ConnMgrGrace),
 		)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	cm, err := connmgr.NewConnManager(
-		cfg.ConnMgr.ConnMgrLo,
-		cfg.ConnMgr.ConnMgrHi,
-		connmgr.WithGracePeriod(cfg.ConnMgr.ConnMgrGrace),
-	)
+	bootstrapPeers, err := relaydaemon.ParsePeers(cfg.Routing.BootstrapPeers)
 	if err != nil {
 		panic(err)
 	}
+	staticPeers, err := relaydaemon.ParsePeers(cfg.Routing.StaticPeers)
+	if err != nil {
+		panic(err)
+	}
+
+	opts = append(opts, libp2p.ConnectionManager(cm))
 
 	ctx := context.Background()
 	var kaddht *dht.IpfsDHT
-	newDHT := func(h libp2phost.Host) (routing.PeerRouting, error) {
-		var err error
-		kaddht, err = dht.New(ctx, h, dht.Mode(dht.ModeServer))
-		return kaddht, err
-	}
+	var router routing.Routing
+	if cfg.Routing.DHTMode != relaydaemon.DHTModeOff {
+		dhtMode, err := relaydaemon.ParseDHTMode(cfg.Routing.DHTMode)
+		if err != nil {
+			panic(err)
+		}
 
-	opts = append(opts,
-		libp2p.ConnectionManager(cm),
-		libp2p.Routing(newDHT),
-	)
+		dhtOpts := []dht.Option{dht.Mode(dhtMode)}
+		if len(bootstrapPeers) > 0 {
+			dhtOpts = append(dhtOpts, dht.BootstrapPeers(bootstrapPeers...))
+		}
+
+		newDHT := func(h libp2phost.Host) (routing.PeerRouting, error) {
+			var err error
+			kaddht, err = dht.New(ctx, h, dhtOpts...)
+			if err != nil {
+				return nil, err
+			}
+			router = kaddht
+			if cfg.Routing.MaxConcurrentLookups > 0 {
+				router = relaydaemon.NewLimitedRouting(kaddht, cfg.Routing.MaxConcurrentLookups)
+			}
+			return router, nil
+		}
+		opts = append(opts, libp2p.Routing(newDHT))
+	} else if cfg.ACL.GroupRecordKey != "" {
+		panic("ACL group records require the DHT")
+	} else if cfg.Daemon.ReadyRequireDHTRefresh {
+		panic("readiness on DHT refresh requires the DHT")
+	}
 
 	host, err := libp2p.New(opts...)
 	if err != nil {
 		panic(err)
 	}
-	err = kaddht.Bootstrap(ctx)
+	host.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    gater.Connected,
+		DisconnectedF: gater.Disconnected,
+	})
+	if s, ok := host.Network().(*swarm.Swarm); ok {
+		gater.SetDialBackoff(s.Backoff())
+	}
+	if cfg.Daemon.LogConnectionAddrs {
+		host.Network().Notify(&network.NotifyBundle{
+			ConnectedF: relaydaemon.LogConnectionAddrs,
+		})
+	}
+	err = relaydaemon.Listen(host, cfg.Network)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if len(cfg.Network.AutoNATDialTransports) > 0 {
+		_, err = relaydaemon.NewNATService(host, cfg.Network.AutoNATDialTransports, psk)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if kaddht != nil {
+		if len(bootstrapPeers) > 0 {
+			bctx, cancel := context.WithTimeout(ctx, cfg.Routing.BootstrapTimeout)
+			n := relaydaemon.ConnectBootstrapPeers(bctx, host, bootstrapPeers, cfg.Routing.BootstrapConcurrency, cfg.Routing.BootstrapRetryMax, cfg.Routing.BootstrapRetryInterval)
+			cancel()
+			relaydaemon.Infof("Connected to %d of %d bootstrap peers\n", n, len(bootstrapPeers))
+		}
+		// the DHT keeps refreshing its routing table in the background, so
+		// the relay runs on even if bootstrapping fails
+		err = relaydaemon.BootstrapDHT(ctx, kaddht, cfg.Routing.BootstrapRetryMax, cfg.Routing.BootstrapRetryInterval)
+		if err != nil {
+			fmt.Printf("error bootstrapping the DHT: %s\n", err)
+		}
+		relaydaemon.Go("dht_mode", func() { relaydaemon.TrackDHTMode(ctx, kaddht) })
 	}
-	fmt.Printf("I am %s\n", host.ID())
-	fmt.Printf("Public Addresses:\n")
+	if len(staticPeers) > 0 {
+		relaydaemon.Go("static_peers", func() {
+			relaydaemon.KeepStaticPeers(ctx, host, staticPeers, cfg.Routing.BootstrapRetryInterval)
+		})
+	}
+	if cfg.Network.AnnounceDNSRecheck > 0 {
+		relaydaemon.Go("dns_recheck", func() { announcer.RecheckDNS(ctx, resolver, cfg.Network.AnnounceDNSRecheck) })
+	}
+	relaydaemon.Infof("I am %s\n", host.ID())
+	relaydaemon.Infof("Public Addresses:\n")
 	for _, addr := range host.Addrs() {
-		fmt.Printf("\t%s/p2p/%s\n", addr, host.ID())
+		relaydaemon.Infof("\t%s/p2p/%s\n", addr, host.ID())
 	}
 
-	go listenPprof(cfg.Daemon.PprofPort)
+	go listenPprof(cfg.Daemon)
 	time.Sleep(10 * time.Millisecond)
 
 	acl, err := relaydaemon.NewACL(host, cfg.ACL)
 	if err != nil {
 		panic(err)
 	}
+	if cfg.ACL.GroupRecordKey != "" {
+		admin, err := relaydaemon.ParseGroupRecordKey(cfg.ACL.GroupRecordKey)
+		if err != nil {
+			panic(err)
+		}
+		if len(cfg.ACL.AllowPeers) == 0 && len(cfg.ACL.AllowSubnets) == 0 {
+			relaydaemon.Infof("Warning: the relay is open until a non-empty ACL group record is resolved, then only allows the listed peers\n")
+		}
+		relaydaemon.Go("acl_group", func() { acl.RefreshGroup(ctx, router, admin, cfg.ACL.GroupRecordInterval) })
+	}
+
+	audit, err := relaydaemon.OpenAuditLog(cfg.Daemon.AuditLogPath)
+	if err != nil {
+		panic(err)
+	}
+	defer audit.Close()
+
+	shutdown := relaydaemon.NewShutdown()
+	if cfg.Daemon.MaxUptime > 0 {
+		shutdown.RequestAfterUptime(cfg.Daemon.MaxUptime, acl)
+	}
+	go listenAdmin(cfg.Daemon, relaydaemon.NewAdmin(cfg, host, acl, limiter, shutdown, audit))
+
+	tracer := relaydaemon.NewMetricsTracer(
+		relayv2.NewMetricsTracer(relayv2.WithRegisterer(prometheus.DefaultRegisterer)),
+		host, cfg.RelayV2.Resources)
+
+	var relayACL relayv2.ACLFilter = acl
+	if cfg.RelayV2.ProtectTopDestinations > 0 {
+		protector := relaydaemon.NewDestinationProtector(acl, host.ConnManager(), tracer, cfg.RelayV2.ProtectTopDestinations)
+		relaydaemon.Go("protector", func() { protector.Run(ctx) })
+		relayACL = protector
+	}
+	if cfg.RelayV2.MaxRefreshesPerReservation > 0 {
+		relayACL = relaydaemon.NewRefreshLimiter(relayACL, host, cfg.RelayV2.MaxRefreshesPerReservation)
+	}
+	if cfg.RelayV2.ReservationStickiness > 0 {
+		relayACL = relaydaemon.NewStickyReservations(relayACL, host, tracer, cfg.RelayV2.Resources.MaxReservations, cfg.RelayV2.ReservationStickiness)
+	}
+	if cfg.RelayV2.IdleReservationTimeout > 0 {
+		idle := relaydaemon.NewIdleReservations(relayACL, host, tracer, cfg.RelayV2.IdleReservationTimeout)
+		relaydaemon.Go("idle_reservations", func() { idle.Run(ctx) })
+		relayACL = idle
+	}
 
+	var relay *relayv2.Relay
 	if cfg.RelayV2.Enabled {
-		fmt.Printf("Starting RelayV2...\n")
-		_, err = relayv2.New(host,
+		relaydaemon.Infof("Starting RelayV2...\n")
+		relay, err = relayv2.New(host,
 			relayv2.WithResources(cfg.RelayV2.Resources),
-			relayv2.WithACL(acl),
-			relayv2.WithMetricsTracer(relayv2.NewMetricsTracer(relayv2.WithRegisterer(prometheus.DefaultRegisterer))))
+			relayv2.WithACL(relayACL),
+			relayv2.WithMetricsTracer(tracer))
+		if err != nil {
+			panic(err)
+		}
+		relaydaemon.Infof("RelayV2 is running!\n")
+	}
+
+	if len(cfg.Network.HideProtocols) > 0 {
+		hider, err := relaydaemon.HideProtocols(host, cfg.Network.HideProtocols)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("RelayV2 is running!\n")
+		relaydaemon.Go("hide_protocols", func() { hider.Run(ctx) })
 	}
 
-	select {}
+	health, err := relaydaemon.NewHealthReporter(ctx, host, tracer)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.Daemon.ReadyRequireDHTRefresh {
+		health.RequireDHTRefresh(ctx, kaddht.RefreshRoutingTable)
+	}
+	http.Handle("/readyz", health)
+	if cfg.Daemon.HealthReportPath != "" {
+		relaydaemon.Go("health_report", func() { health.WriteReports(ctx, cfg.Daemon.HealthReportPath, cfg.Daemon.HealthReportInterval) })
+	}
+
+	if cfg.Daemon.SummaryInterval > 0 {
+		relaydaemon.Go("summary", func() { relaydaemon.LogSummary(ctx, cfg.Daemon.SummaryInterval, host, tracer) })
+	}
+
+	if cfg.Daemon.StatsDAddr != "" {
+		relaydaemon.Go("statsd", func() {
+			err := relaydaemon.PushStatsD(ctx, cfg.Daemon.StatsDAddr, cfg.Daemon.StatsDInterval, host, tracer)
+			if err != nil {
+				fmt.Printf("error pushing StatsD metrics: %s\n", err)
+			}
+		})
+	}
+
+	relaydaemon.Go("sighup", func() { reloadOnSighup(*idPath, host, limiter) })
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigs:
+		if sig == syscall.SIGQUIT {
+			dumpDiagnostics(host, cfg)
+			os.Exit(2)
+		}
+	case <-shutdown.Done():
+	}
+
+	relaydaemon.Infof("Shutting down...\n")
+	if cfg.Daemon.ReservationDumpPath != "" {
+		err := relaydaemon.WriteReservations(cfg.Daemon.ReservationDumpPath, host, tracer)
+		if err != nil {
+			fmt.Printf("error writing reservations: %s\n", err)
+		}
+	}
+	if relay != nil {
+		relay.Close()
+	}
+	if kaddht != nil {
+		kaddht.Close()
+	}
+	host.Close()
+}
+
+// reloadOnSighup reloads the resource manager limits whenever the daemon
+// receives SIGHUP. The identity cannot change while running, so it is only
+// checked to warn if it became unusable; the running host is left untouched.
+func reloadOnSighup(idPath string, host libp2phost.Host, limiter *relaydaemon.Limiter) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := relaydaemon.CheckIdentity(idPath, host.ID()); err != nil {
+			fmt.Printf("warning: identity file %s: %s; keeping the running identity\n", idPath, err)
+		}
+
+		report, err := limiter.Reload(host.Network().ResourceManager())
+		if err != nil {
+			fmt.Printf("error reloading resource limits: %s\n", err)
+			continue
+		}
+		relaydaemon.Infof("Reloaded resource limits; applied live: %v; new scopes only: %v; requires restart: %v\n",
+			report.Live, report.NewScopes, report.Restart)
+	}
 }
 
-func listenPprof(p int) {
+// dumpDiagnostics writes the diagnostic bundle to a file in the temporary
+// directory, for post-mortem debugging.
+func dumpDiagnostics(host libp2phost.Host, cfg relaydaemon.Config) {
+	// the file is created with a random name, readable only by the owner
+	f, err := os.CreateTemp("", fmt.Sprintf("relayd-diagnostics-%d-*.txt", time.Now().Unix()))
+	if err != nil {
+		fmt.Printf("error creating diagnostics file: %s\n", err)
+		return
+	}
+	defer f.Close()
+	path := f.Name()
+
+	if err := relaydaemon.WriteDiagnostics(f, host, cfg); err != nil {
+		fmt.Printf("error writing diagnostics: %s\n", err)
+		return
+	}
+	fmt.Printf("Diagnostics written to %s\n", path)
+}
+
+// probeRelay acts as a relay client, testing that the relay at the given
+// address can be used to connect to the target peer.
+func probeRelay(relayAddr, target, pskPath string) {
+	relay, err := peer.AddrInfoFromString(relayAddr)
+	if err != nil {
+		log.Fatalf("error parsing relay address: %s", err)
+	}
+	targetID, err := peer.Decode(target)
+	if err != nil {
+		log.Fatalf("error parsing target peer ID: %s", err)
+	}
+
+	// NoListenAddrs disables the relay transport unless explicitly enabled
+	opts := []libp2p.Option{libp2p.NoListenAddrs, libp2p.EnableRelay()}
+	if pskPath != "" {
+		psk, _, err := relaydaemon.LoadSwarmKey(pskPath)
+		if err != nil {
+			log.Fatalf("error loading swarm key: %s", err)
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	latency, err := relaydaemon.ProbeRelay(ctx, h, *relay, targetID)
+	if err != nil {
+		log.Fatalf("relay probe failed: %s", err)
+	}
+	fmt.Printf("Connected to %s through %s in %s\n", targetID, relay.ID, latency)
+}
+
+func listenPprof(cfg relaydaemon.DaemonConfig) {
+	p := cfg.PprofPort
 	if p == -1 {
-		fmt.Printf("The pprof debug is disabled\n")
+		relaydaemon.Infof("The pprof debug is disabled\n")
 		return
 	}
 	addr := fmt.Sprintf("localhost:%d", p)
-	fmt.Printf("Registering pprof debug http handler at: http://%s/debug/pprof/\n", addr)
-	switch err := http.ListenAndServe(addr, nil); err {
+	relaydaemon.Infof("Registering pprof debug http handler at: http://%s/debug/pprof/\n", addr)
+	switch err := relaydaemon.NewHTTPServer(cfg, addr, nil).ListenAndServe(); err {
 	case nil:
 		// all good, server is running and exited normally.
 	case http.ErrServerClosed:
@@ -195,3 +487,31 @@ func listenPprof(p int) {
 		panic(err)
 	}
 }
+
+func listenAdmin(cfg relaydaemon.DaemonConfig, handler http.Handler) {
+	p := cfg.AdminPort
+	if p == -1 {
+		relaydaemon.Infof("The admin API is disabled\n")
+		return
+	}
+	addr := fmt.Sprintf("localhost:%d", p)
+	relaydaemon.Infof("Registering admin http handler at: http://%s/admin/\n", addr)
+	if cfg.AdminToken == "" {
+		relaydaemon.Infof("The mutating admin endpoints are disabled without an admin token\n")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("error registering admin http handler at: %s: %s\n", addr, err)
+		panic(err)
+	}
+	if cfg.AdminMaxConns > 0 {
+		l = relaydaemon.LimitListener(l, cfg.AdminMaxConns)
+	}
+	switch err := relaydaemon.NewHTTPServer(cfg, addr, handler).Serve(l); err {
+	case nil, http.ErrServerClosed:
+		// all good, server is running and exited normally.
+	default:
+		fmt.Printf("error registering admin http handler at: %s: %s\n", addr, err)
+		panic(err)
+	}
+}
@@ -1,11 +1,18 @@
 package relaydaemon
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"gopkg.in/yaml.v3"
 )
 
 // Config stores the full configuration of the relays, ACLs and other settings
@@ -13,6 +20,7 @@ import (
 type Config struct {
 	Network NetworkConfig
 	ConnMgr ConnMgrConfig
+	Routing RoutingConfig
 	RelayV2 RelayV2Config
 	ACL     ACLConfig
 	Daemon  DaemonConfig
@@ -20,37 +28,125 @@ type Config struct {
 
 // DaemonConfig controls settings for the relay-daemon itself.
 type DaemonConfig struct {
-	PprofPort int
-	PromPort  int
+	PprofPort              int
+	PromPort               int
+	AdminPort              int
+	AdminMaxConns          int
+	AdminToken             string
+	AllowRemoteShutdown    bool
+	ShutdownToken          string
+	LimitsPath             string
+	DHTMemoryLimit         int64
+	RelayMemoryLimit       int64
+	MetricsWarmup          time.Duration
+	LogConnectionAddrs     bool
+	HealthReportPath       string
+	HealthReportInterval   time.Duration
+	ReadyRequireDHTRefresh bool
+	HTTPReadTimeout        time.Duration
+	HTTPWriteTimeout       time.Duration
+	AuditLogPath           string
+	MaxUptime              time.Duration
+	MaxMetricSeries        int
+	ReservationDumpPath    string
+	Quiet                  bool
+	StatsDAddr             string
+	StatsDInterval         time.Duration
+	SummaryInterval        time.Duration
 }
 
 // NetworkConfig controls listen and annouce settings for the libp2p host.
 type NetworkConfig struct {
-	ListenAddrs   []string
-	AnnounceAddrs []string
+	ListenAddrs           []string
+	AllowNoListen         bool
+	AnnounceAddrs         []string
+	AnnounceCIDRs         []string
+	AnnounceDNSRecheck    time.Duration
+	MaxConnsPerIPv6ASN    int
+	MaxConnsPerPeer       int
+	MaxInboundConns       int
+	MaxOutboundConns      int
+	MaxPendingDials       int
+	SwarmKeyNextPath      string
+	ActiveSwarmKey        string
+	HideProtocols         []string
+	AutoNATDialTransports []string
+	DNSResolver           string
+	AnnounceOverrides     map[string]string
+
+	MaxAnnouncedTransportsPerIP  int
+	AnnouncedTransportPreference []string
 }
 
 // ConnMgrConfig controls the libp2p connection manager settings.
 type ConnMgrConfig struct {
+	Disabled     bool
 	ConnMgrLo    int
 	ConnMgrHi    int
 	ConnMgrGrace time.Duration
 }
 
+// RoutingConfig controls the DHT used for peer routing.
+type RoutingConfig struct {
+	DHTMode                string
+	BootstrapRetryMax      int
+	BootstrapRetryInterval time.Duration
+	BootstrapPeers         []string
+	BootstrapConcurrency   int
+	BootstrapTimeout       time.Duration
+	StaticPeers            []string
+	MaxConcurrentLookups   int
+}
+
 // RelayV2Config controls activation of V2 circuits and resouce configuration
 // for them.
 type RelayV2Config struct {
-	Enabled   bool
-	Resources relayv2.Resources
+	Enabled                bool
+	Resources              relayv2.Resources
+	ProtectTopDestinations int
+
+	MaxRefreshesPerReservation int
+	ReservationStickiness      time.Duration
+	IdleReservationTimeout     time.Duration
 }
 
 // ACLConfig provides filtering configuration to allow specific peers or
 // subnets to be fronted by relays. In V2, this specifies the peers/subnets
 // that are able to make reservations on the relay. In V1, this specifies the
 // peers/subnets that can be contacted through the relays.
+// Profiles are alternative named ACL configs that can be activated at runtime
+// through the admin API. If GroupRecordKey is set, the peers of the group
+// record with this key are periodically resolved from the DHT and allowed in
+// addition to AllowPeers; a non-empty group record thus closes an otherwise
+// open relay to the peers it lists.
 type ACLConfig struct {
-	AllowPeers   []string
-	AllowSubnets []string
+	Mode             string
+	AllowPeers       []string
+	AllowSubnets     []string
+	AllowConnectOnly []string
+	DisconnectOnDeny bool
+	Profiles         map[string]ACLConfig
+
+	RejectReservationsWithPublicAddrs bool
+
+	MinScore      float64
+	ScoreHalfLife time.Duration
+
+	DecisionCacheSize int
+	DecisionCacheTTL  time.Duration
+
+	RateLimitTiers map[string]RateLimitTier
+
+	GroupRecordKey      string
+	GroupRecordInterval time.Duration
+}
+
+// RateLimitTier contains the reservation rate limit of a group of peers.
+type RateLimitTier struct {
+	Peers    []string
+	Subnets  []string
+	Interval time.Duration
+	Burst    int
 }
 
 // DefaultConfig returns a default relay configuration using default resource
@@ -64,18 +160,37 @@ func DefaultConfig() Config {
 				"/ip4/0.0.0.0/tcp/4001",
 				"/ip6/::/tcp/4001",
 			},
+			AnnouncedTransportPreference: []string{"quic", "tcp", "webtransport", "websocket"},
 		},
 		ConnMgr: ConnMgrConfig{
 			ConnMgrLo:    512,
 			ConnMgrHi:    768,
 			ConnMgrGrace: 2 * time.Minute,
 		},
+		Routing: RoutingConfig{
+			DHTMode:                "server",
+			BootstrapRetryMax:      5,
+			BootstrapRetryInterval: time.Second,
+			BootstrapConcurrency:   4,
+			BootstrapTimeout:       30 * time.Second,
+		},
 		RelayV2: RelayV2Config{
 			Enabled:   true,
 			Resources: relayv2.DefaultResources(),
 		},
+		ACL: ACLConfig{
+			GroupRecordInterval: 10 * time.Minute,
+			ScoreHalfLife:       10 * time.Minute,
+			DecisionCacheTTL:    time.Minute,
+		},
 		Daemon: DaemonConfig{
-			PprofPort: 6060,
+			PprofPort:            6060,
+			AdminPort:            -1,
+			AdminMaxConns:        16,
+			HealthReportInterval: 10 * time.Second,
+			HTTPReadTimeout:      10 * time.Second,
+			HTTPWriteTimeout:     time.Minute,
+			StatsDInterval:       10 * time.Second,
 		},
 	}
 }
@@ -102,3 +217,145 @@ func LoadConfig(cfgPath string) (Config, error) {
 
 	return cfg, nil
 }
+
+// maxBootstrapRetries is the maximum of Routing.BootstrapRetryMax.
+const maxBootstrapRetries = 100
+
+// Validate checks the given config for invalid settings that are not
+// otherwise rejected when the daemon starts.
+func (c Config) Validate() error {
+	if c.Routing.BootstrapRetryMax < 0 || c.Routing.BootstrapRetryMax > maxBootstrapRetries {
+		return fmt.Errorf("invalid bootstrap retry max: %d; must be between 0 and %d", c.Routing.BootstrapRetryMax, maxBootstrapRetries)
+	}
+	if c.Routing.BootstrapRetryInterval < 0 {
+		return fmt.Errorf("invalid bootstrap retry interval: %s", c.Routing.BootstrapRetryInterval)
+	}
+
+	return nil
+}
+
+// MergeConfigDir merges all JSON (*.json) and YAML (*.yaml, *.yml) config
+// fragments in the given directory into the given configuration, in lexical
+// order of their file names; fields set in later fragments take precedence.
+// YAML fragments use the same field names as JSON ones; unlike in JSON,
+// durations can also be given as strings, such as "10s".
+func MergeConfigDir(cfg *Config, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".json", ".yaml", ".yml":
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := mergeConfigFragment(cfg, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("error loading config fragment %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func mergeConfigFragment(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		// convert to JSON, so that fragments are decoded identically
+		var fragment map[string]any
+		if err := yaml.Unmarshal(data, &fragment); err != nil {
+			return err
+		}
+		if _, err := yamlDurations(fragment, reflect.TypeOf(cfg)); err != nil {
+			return err
+		}
+		data, err = json.Marshal(fragment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return json.NewDecoder(bytes.NewReader(data)).Decode(cfg)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// yamlDurations converts the duration strings of the given decoded YAML
+// value to nanoseconds, where the corresponding field of the given config
+// type is a duration, as JSON decodes durations from integers only. Maps
+// are converted in place.
+func yamlDurations(v any, t reflect.Type) (any, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		return int64(d), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v, nil
+		}
+		for k, fv := range m {
+			// JSON matches field names case-insensitively
+			f, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, k) })
+			if !ok {
+				continue
+			}
+			conv, err := yamlDurations(fv, f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			m[k] = conv
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v, nil
+		}
+		for k, ev := range m {
+			conv, err := yamlDurations(ev, t.Elem())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			m[k] = conv
+		}
+	case reflect.Slice, reflect.Array:
+		s, ok := v.([]any)
+		if !ok {
+			return v, nil
+		}
+		for i, ev := range s {
+			conv, err := yamlDurations(ev, t.Elem())
+			if err != nil {
+				return nil, err
+			}
+			s[i] = conv
+		}
+	}
+
+	return v, nil
+}
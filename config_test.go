@@ -0,0 +1,144 @@
+package relaydaemon
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeConfigDir(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fragments map[string]string
+		check     func(t *testing.T, cfg Config)
+		wantErr   bool
+	}{
+		{
+			name: "JSON and YAML fragments merge over the defaults",
+			fragments: map[string]string{
+				"10-network.json": `{"Network": {"ListenAddrs": ["/ip4/0.0.0.0/tcp/4002"]}}`,
+				"20-acl.yaml":     "ACL:\n  AllowPeers: [\"12D3KooWETr1NNvq8P4SnTeNirjonLpjjb3fxgtzZdwQAsAewXsN\"]\n",
+			},
+			check: func(t *testing.T, cfg Config) {
+				if !reflect.DeepEqual(cfg.Network.ListenAddrs, []string{"/ip4/0.0.0.0/tcp/4002"}) {
+					t.Errorf("listen addrs: %v", cfg.Network.ListenAddrs)
+				}
+				if len(cfg.ACL.AllowPeers) != 1 {
+					t.Errorf("allow peers: %v", cfg.ACL.AllowPeers)
+				}
+				if cfg.ConnMgr.ConnMgrHi != DefaultConfig().ConnMgr.ConnMgrHi {
+					t.Errorf("unset field overridden: %d", cfg.ConnMgr.ConnMgrHi)
+				}
+			},
+		},
+		{
+			name: "later fragments take precedence",
+			fragments: map[string]string{
+				"b.yml":  "Daemon:\n  PprofPort: 2\n",
+				"a.json": `{"Daemon": {"PprofPort": 1, "AdminPort": 9000}}`,
+			},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Daemon.PprofPort != 2 || cfg.Daemon.AdminPort != 9000 {
+					t.Errorf("pprof port %d, admin port %d", cfg.Daemon.PprofPort, cfg.Daemon.AdminPort)
+				}
+			},
+		},
+		{
+			name: "YAML durations",
+			fragments: map[string]string{
+				"a.yaml": "Daemon:\n  MetricsWarmup: 10s\n  HealthReportInterval: 60000000000\n" +
+					"RelayV2:\n  Resources:\n    ReservationTTL: 1h30m\n    Limit:\n      Duration: 2m\n" +
+					"ACL:\n  Profiles:\n    lockdown:\n      decisioncachettl: 5s\n",
+			},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Daemon.MetricsWarmup != 10*time.Second {
+					t.Errorf("metrics warmup: %s", cfg.Daemon.MetricsWarmup)
+				}
+				if cfg.Daemon.HealthReportInterval != time.Minute {
+					t.Errorf("health report interval: %s", cfg.Daemon.HealthReportInterval)
+				}
+				if cfg.RelayV2.Resources.ReservationTTL != 90*time.Minute {
+					t.Errorf("reservation TTL: %s", cfg.RelayV2.Resources.ReservationTTL)
+				}
+				if cfg.RelayV2.Resources.Limit.Duration != 2*time.Minute {
+					t.Errorf("limit duration: %s", cfg.RelayV2.Resources.Limit.Duration)
+				}
+				if ttl := cfg.ACL.Profiles["lockdown"].DecisionCacheTTL; ttl != 5*time.Second {
+					t.Errorf("profile decision cache TTL: %s", ttl)
+				}
+			},
+		},
+		{
+			name: "invalid YAML durations fail",
+			fragments: map[string]string{
+				"a.yaml": "Daemon:\n  MetricsWarmup: soon\n",
+			},
+			wantErr: true,
+		},
+		{
+			name: "other files are ignored",
+			fragments: map[string]string{
+				"notes.txt": "not a config",
+			},
+			check: func(t *testing.T, cfg Config) {
+				if !reflect.DeepEqual(cfg, DefaultConfig()) {
+					t.Error("config changed")
+				}
+			},
+		},
+		{
+			name: "invalid fragments fail",
+			fragments: map[string]string{
+				"broken.json": `{"Daemon": `,
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tc.fragments {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := DefaultConfig()
+			err := MergeConfigDir(&cfg, dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		edit    func(*Config)
+		wantErr bool
+	}{
+		{name: "default", edit: func(*Config) {}},
+		{name: "no bootstrap retries", edit: func(c *Config) { c.Routing.BootstrapRetryMax = 0 }},
+		{name: "maximum bootstrap retries", edit: func(c *Config) { c.Routing.BootstrapRetryMax = maxBootstrapRetries }},
+		{name: "negative bootstrap retries", edit: func(c *Config) { c.Routing.BootstrapRetryMax = -1 }, wantErr: true},
+		{name: "too many bootstrap retries", edit: func(c *Config) { c.Routing.BootstrapRetryMax = maxBootstrapRetries + 1 }, wantErr: true},
+		{name: "negative bootstrap retry interval", edit: func(c *Config) { c.Routing.BootstrapRetryInterval = -time.Second }, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.edit(&cfg)
+			if err := cfg.Validate(); (err != nil) != tc.wantErr {
+				t.Fatalf("error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
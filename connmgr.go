@@ -0,0 +1,117 @@
+package relaydaemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TagConnMgr is a connection manager that never trims connections, but keeps
+// the peer tags like the basic connection manager does. The relay tracks its
+// reservations through tags, which the daemon relies on to list the reserved
+// peers, so disabling the connection manager must not drop them.
+type TagConnMgr struct {
+	connmgr.NullConnMgr
+
+	mx   sync.Mutex
+	tags map[peer.ID]*connmgr.TagInfo
+}
+
+var _ connmgr.ConnManager = (*TagConnMgr)(nil)
+
+// NewTagConnMgr returns a connection manager that keeps peer tags but never
+// trims connections.
+func NewTagConnMgr() *TagConnMgr {
+	return &TagConnMgr{tags: make(map[peer.ID]*connmgr.TagInfo)}
+}
+
+// TagPeer sets the value of a tag of the given peer.
+func (cm *TagConnMgr) TagPeer(p peer.ID, tag string, val int) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+
+	info := cm.info(p)
+	info.Value += val - info.Tags[tag]
+	info.Tags[tag] = val
+}
+
+// UntagPeer removes a tag of the given peer.
+func (cm *TagConnMgr) UntagPeer(p peer.ID, tag string) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+
+	info, ok := cm.tags[p]
+	if !ok {
+		return
+	}
+	info.Value -= info.Tags[tag]
+	delete(info.Tags, tag)
+}
+
+// UpsertTag updates the value of a tag of the given peer.
+func (cm *TagConnMgr) UpsertTag(p peer.ID, tag string, upsert func(int) int) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+
+	info := cm.info(p)
+	old := info.Tags[tag]
+	info.Tags[tag] = upsert(old)
+	info.Value += info.Tags[tag] - old
+}
+
+// GetTagInfo returns a copy of the tags of the given peer, or nil if it has
+// none.
+func (cm *TagConnMgr) GetTagInfo(p peer.ID) *connmgr.TagInfo {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+
+	info, ok := cm.tags[p]
+	if !ok {
+		return nil
+	}
+
+	out := &connmgr.TagInfo{
+		FirstSeen: info.FirstSeen,
+		Value:     info.Value,
+		Tags:      make(map[string]int, len(info.Tags)),
+	}
+	for tag, val := range info.Tags {
+		out.Tags[tag] = val
+	}
+	return out
+}
+
+// Notifee returns a notifiee dropping the tags of peers once they are fully
+// disconnected.
+func (cm *TagConnMgr) Notifee() network.Notifiee {
+	return &network.NotifyBundle{
+		DisconnectedF: cm.disconnected,
+	}
+}
+
+func (cm *TagConnMgr) disconnected(n network.Network, c network.Conn) {
+	p := c.RemotePeer()
+	if n.Connectedness(p) == network.Connected {
+		return
+	}
+
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+
+	delete(cm.tags, p)
+}
+
+func (cm *TagConnMgr) info(p peer.ID) *connmgr.TagInfo {
+	info, ok := cm.tags[p]
+	if !ok {
+		info = &connmgr.TagInfo{
+			FirstSeen: time.Now(),
+			Tags:      make(map[string]int),
+		}
+		cm.tags[p] = info
+	}
+	return info
+}
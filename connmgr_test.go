@@ -0,0 +1,95 @@
+package relaydaemon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// testNetwork is a network of which only the connected peers, and possibly
+// their connections, are known.
+type testNetwork struct {
+	network.Network
+
+	connected map[peer.ID]bool
+	conns     map[peer.ID][]network.Conn
+	closed    []peer.ID
+	rm        network.ResourceManager
+	ps        peerstore.Peerstore
+}
+
+func (n *testNetwork) Peers() []peer.ID {
+	var peers []peer.ID
+	for p, ok := range n.connected {
+		if ok {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func (n *testNetwork) ConnsToPeer(p peer.ID) []network.Conn { return n.conns[p] }
+
+func (n *testNetwork) Conns() []network.Conn {
+	var conns []network.Conn
+	for _, cs := range n.conns {
+		conns = append(conns, cs...)
+	}
+	return conns
+}
+func (n *testNetwork) Notify(network.Notifiee) {}
+
+func (n *testNetwork) ResourceManager() network.ResourceManager { return n.rm }
+func (n *testNetwork) Peerstore() peerstore.Peerstore           { return n.ps }
+
+func (n *testNetwork) ClosePeer(p peer.ID) error {
+	n.closed = append(n.closed, p)
+	return nil
+}
+
+func (n *testNetwork) Connectedness(p peer.ID) network.Connectedness {
+	if n.connected[p] {
+		return network.Connected
+	}
+	return network.NotConnected
+}
+
+func TestTagConnMgr(t *testing.T) {
+	cm := NewTagConnMgr()
+	p := peer.ID("reserved")
+
+	cm.TagPeer(p, ReservationTag, 10)
+	cm.UpsertTag(p, "other", func(v int) int { return v + 2 })
+	cm.UpsertTag(p, "other", func(v int) int { return v + 2 })
+	cm.TrimOpenConns(context.Background())
+
+	info := cm.GetTagInfo(p)
+	if info == nil {
+		t.Fatal("tags dropped")
+	}
+	if info.Tags[ReservationTag] != 10 || info.Tags["other"] != 4 || info.Value != 14 {
+		t.Fatalf("unexpected tags: %v, value %d", info.Tags, info.Value)
+	}
+
+	cm.UntagPeer(p, "other")
+	if info := cm.GetTagInfo(p); len(info.Tags) != 1 || info.Value != 10 {
+		t.Fatalf("unexpected tags after untag: %v, value %d", info.Tags, info.Value)
+	}
+
+	// tags are kept while the peer has other connections, and dropped once
+	// it is fully disconnected
+	n := &testNetwork{connected: map[peer.ID]bool{p: true}}
+	c := &testConn{peer: p}
+	cm.Notifee().Disconnected(n, c)
+	if cm.GetTagInfo(p) == nil {
+		t.Fatal("tags dropped while connected")
+	}
+	n.connected[p] = false
+	cm.Notifee().Disconnected(n, c)
+	if cm.GetTagInfo(p) != nil {
+		t.Fatal("tags kept after disconnect")
+	}
+}
@@ -0,0 +1,134 @@
+package relaydaemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ReservationTag is the connection manager tag the relay sets on peers
+// holding an active reservation.
+const ReservationTag = "relay-reservation"
+
+// RelayHopTag is the connection manager tag the relay sets on the peers of
+// its open circuits.
+const RelayHopTag = "relay-v2-hop"
+
+// ReservedPeers returns the peers currently holding a reservation on the
+// relay, as tracked by the connection manager.
+func ReservedPeers(h host.Host) []peer.ID {
+	var peers []peer.ID
+	for _, p := range h.Network().Peers() {
+		if hasReservation(h, p) {
+			peers = append(peers, p)
+		}
+	}
+
+	return peers
+}
+
+// hasReservation returns true if the given peer holds a reservation on the
+// relay.
+func hasReservation(h host.Host, p peer.ID) bool {
+	return hasTag(h.ConnManager(), p, ReservationTag)
+}
+
+// hasTag returns true if the given peer has the given tag in the connection
+// manager.
+func hasTag(cm connmgr.ConnManager, p peer.ID, tag string) bool {
+	info := cm.GetTagInfo(p)
+	if info == nil {
+		return false
+	}
+	_, ok := info.Tags[tag]
+	return ok
+}
+
+// ReservationInfo describes an active reservation.
+type ReservationInfo struct {
+	Peer    peer.ID   `json:"peer"`
+	Addrs   []string  `json:"addrs"`
+	Granted time.Time `json:"granted"`
+}
+
+// Reservations returns the active reservations on the relay, with the
+// connection addresses of the peers holding them and the time they were
+// granted as tracked by the given metrics tracer.
+func Reservations(h host.Host, tracer *MetricsTracer) []ReservationInfo {
+	peers := ReservedPeers(h)
+	infos := make([]ReservationInfo, 0, len(peers))
+	for _, p := range peers {
+		info := ReservationInfo{
+			Peer:    p,
+			Granted: tracer.Granted(p),
+		}
+		for _, c := range h.Network().ConnsToPeer(p) {
+			info.Addrs = append(info.Addrs, c.RemoteMultiaddr().String())
+		}
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// WriteReservations atomically writes the active reservations on the relay
+// as JSON to the given path.
+func WriteReservations(path string, h host.Host, tracer *MetricsTracer) error {
+	return writeFileAtomic(path, Reservations(h, tracer))
+}
+
+// WriteDiagnostics writes a diagnostic bundle for post-mortem debugging to the
+// given writer, consisting of the goroutine stacks, the active reservations,
+// the open connections and the running config, with its secrets redacted.
+func WriteDiagnostics(w io.Writer, h host.Host, cfg Config) error {
+	fmt.Fprintf(w, "=== goroutines ===\n")
+	if err := pprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n=== reservations ===\n")
+	for _, p := range ReservedPeers(h) {
+		fmt.Fprintf(w, "%s\n", p)
+	}
+
+	fmt.Fprintf(w, "\n=== connections ===\n")
+	for _, c := range h.Network().Conns() {
+		stat := c.Stat()
+		fmt.Fprintf(w, "%s %s %s %s\n", c.RemotePeer(), c.RemoteMultiaddr(), stat.Direction, stat.Opened.Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(w, "\n=== config ===\n")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(redactConfig(cfg))
+}
+
+// redactedSecret replaces the secrets of the config in diagnostics.
+const redactedSecret = "<redacted>"
+
+// redactConfig returns a copy of the given config without its secrets.
+func redactConfig(cfg Config) Config {
+	if cfg.Daemon.AdminToken != "" {
+		cfg.Daemon.AdminToken = redactedSecret
+	}
+	if cfg.Daemon.ShutdownToken != "" {
+		cfg.Daemon.ShutdownToken = redactedSecret
+	}
+	return cfg
+}
+
+// LogConnectionAddrs handles the Connect notification and logs all known
+// addresses of the connected peer, for debugging NAT and transport issues.
+func LogConnectionAddrs(n network.Network, c network.Conn) {
+	p := c.RemotePeer()
+	Infof("Connected to %s via %s (%s); known addresses: %v\n",
+		p, c.RemoteMultiaddr(), c.Stat().Direction, n.Peerstore().Addrs(p))
+}
@@ -0,0 +1,148 @@
+package relaydaemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestWriteDiagnostics(t *testing.T) {
+	h := newTestHost()
+	p := peer.ID("reserved")
+	h.reserve(p)
+	c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+	h.net.conns = map[peer.ID][]network.Conn{c.peer: {c}}
+
+	cfg := DefaultConfig()
+	cfg.Daemon.ShutdownToken = "secret-token"
+	cfg.Daemon.AdminToken = "secret-admin-token"
+
+	var buf bytes.Buffer
+	if err := WriteDiagnostics(&buf, h, cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"=== goroutines ===\ngoroutine ",
+		"=== reservations ===\n" + p.String() + "\n",
+		"=== connections ===\n" + c.peer.String() + " /ip4/1.2.3.4/tcp/4001 Inbound",
+		"=== config ===\n{",
+		`"AdminToken": "` + redactedSecret + `"`,
+		`"ShutdownToken": "` + redactedSecret + `"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+	if strings.Contains(out, "secret-token") || strings.Contains(out, "secret-admin-token") {
+		t.Error("token written")
+	}
+	if cfg.Daemon.ShutdownToken != "secret-token" {
+		t.Error("config modified")
+	}
+}
+
+// captureOutput returns what the given function prints to the standard
+// output.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestLogConnectionAddrs(t *testing.T) {
+	h := newTestHost()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	h.net.ps = ps
+
+	c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+	known := parseTestAddrs(t, []string{"/ip4/1.2.3.4/tcp/4001", "/ip4/1.2.3.4/udp/4001/quic-v1"})
+	h.net.ps.AddAddrs(c.peer, known, time.Hour)
+
+	out := captureOutput(t, func() { LogConnectionAddrs(h.net, c) })
+
+	for _, want := range []string{
+		"Connected to " + c.peer.String(),
+		"via /ip4/1.2.3.4/tcp/4001",
+		"(Inbound)",
+		"known addresses:",
+		"/ip4/1.2.3.4/udp/4001/quic-v1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+}
+
+func TestWriteReservations(t *testing.T) {
+	h := newTestHost()
+	h.net.conns = make(map[peer.ID][]network.Conn)
+	clk := clock.NewMock()
+	clk.Set(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+	tracer.clock = clk
+
+	reserved, unreserved := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+	c.peer = reserved
+	h.net.conns[reserved] = []network.Conn{c}
+	h.reserve(reserved)
+	h.net.connected[unreserved] = true
+	tracer.ReservationAllowed(false)
+
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	if err := WriteReservations(path, h, tracer); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ReservationInfo
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ReservationInfo{{
+		Peer:    reserved,
+		Addrs:   []string{"/ip4/1.2.3.4/tcp/4001"},
+		Granted: clk.Now(),
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reservations %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,515 @@
+package relaydaemon
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	asnutil "github.com/libp2p/go-libp2p-asn-util"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ConnGater implements the libp2p connection gater interface, enforcing the
+// connection limits of the relay daemon network config.
+type ConnGater struct {
+	clock clock.Clock
+
+	maxConnsPerIPv6ASN int
+	maxConnsPerPeer    int
+	maxInboundConns    int
+	maxOutboundConns   int
+	maxPendingDials    int
+
+	// connection tracking per ASN and direction; inbound connections hold
+	// their ASN and direction slots from the time they are accepted, and
+	// outbound connections their direction slot from the time they are
+	// dialed. These slots are pending until connected and expire with the
+	// handshake timeout.
+	mx            sync.Mutex
+	asnConns      map[string]int
+	asnPending    map[string]asnSlot
+	inboundConns  int
+	outboundConns int
+	dirPending    map[string]dirSlot
+
+	// inbound handshake tracking; failed handshakes are not signaled to the
+	// gater, so entries expire after the handshake timeout.
+	hsMx      sync.Mutex
+	handshake map[string]time.Time
+	lastSweep time.Time
+
+	// outbound dial tracking per peer; failed dials are not signaled to the
+	// gater either, so entries are released once the swarm backs off from all
+	// the addresses dialed, and otherwise expire after the dial timeout.
+	dialMx        sync.Mutex
+	dials         map[peer.ID]*pendingDial
+	dialBackoff   DialBackoff
+	lastDialSweep time.Time
+}
+
+type pendingDial struct {
+	started time.Time
+	addrs   []ma.Multiaddr
+}
+
+// DialBackoff reports whether dials to an address of a peer are backed off,
+// which the swarm does after a dial to the address failed.
+type DialBackoff interface {
+	Backoff(p peer.ID, addr ma.Multiaddr) bool
+}
+
+type asnSlot struct {
+	asn      string
+	accepted time.Time
+}
+
+type dirSlot struct {
+	dir     network.Direction
+	started time.Time
+}
+
+// handshakeTimeout matches the libp2p upgrader timeout for inbound
+// connection handshakes.
+const handshakeTimeout = 15 * time.Second
+
+// dialAddrGrace is the time after which a pending dial for which no address
+// was dialed is considered failed; the swarm fails such dials right away.
+const dialAddrGrace = time.Second
+
+var _ connmgr.ConnectionGater = (*ConnGater)(nil)
+
+// NewConnGater returns a connection gater using the given relay daemon
+// network config.
+func NewConnGater(cfg NetworkConfig) *ConnGater {
+	return &ConnGater{
+		clock:              clock.New(),
+		maxConnsPerIPv6ASN: cfg.MaxConnsPerIPv6ASN,
+		maxConnsPerPeer:    cfg.MaxConnsPerPeer,
+		maxInboundConns:    cfg.MaxInboundConns,
+		maxOutboundConns:   cfg.MaxOutboundConns,
+		maxPendingDials:    cfg.MaxPendingDials,
+		asnConns:           make(map[string]int),
+		asnPending:         make(map[string]asnSlot),
+		dirPending:         make(map[string]dirSlot),
+		handshake:          make(map[string]time.Time),
+		dials:              make(map[peer.ID]*pendingDial),
+	}
+}
+
+// InterceptPeerDial rejects dials once the outbound connection limit or the
+// pending dial limit is reached.
+func (g *ConnGater) InterceptPeerDial(p peer.ID) bool {
+	key := dialKey(p)
+	if !g.reserveDirection(network.DirOutbound, key) {
+		return false
+	}
+	if !g.dialStarted(p) {
+		g.releaseDirection(key)
+		return false
+	}
+
+	return true
+}
+
+// SetDialBackoff sets the dial backoff of the swarm, through which failed
+// dials release their pending dial slot. It is set once the host is created.
+func (g *ConnGater) SetDialBackoff(b DialBackoff) {
+	g.dialMx.Lock()
+	defer g.dialMx.Unlock()
+
+	g.dialBackoff = b
+}
+
+// InterceptAddrDial always allows dialing, tracking the addresses dialed for
+// the pending dial of the peer.
+func (g *ConnGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	if g.maxPendingDials <= 0 {
+		return true
+	}
+
+	g.dialMx.Lock()
+	defer g.dialMx.Unlock()
+
+	if d, ok := g.dials[p]; ok {
+		d.addrs = append(d.addrs, addr)
+	}
+	return true
+}
+
+// InterceptAccept rejects inbound connections once the inbound connection
+// limit is reached, or from networks that have reached their connection
+// limit.
+func (g *ConnGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	key := handshakeKey(addrs)
+	if !g.reserveDirection(network.DirInbound, key) {
+		return false
+	}
+	if !g.reserveASN(addrs) {
+		g.releaseDirection(key)
+		return false
+	}
+
+	g.handshakeStarted(addrs)
+	return true
+}
+
+// InterceptSecured always allows the connection.
+func (g *ConnGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if dir == network.DirInbound {
+		g.handshakeDone(addrs)
+	}
+
+	return true
+}
+
+// InterceptUpgraded always allows the connection.
+func (g *ConnGater) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// Connected handles the Connect notification, accounting the connection to
+// its direction and the ASN of its remote address, and closing the oldest
+// connections of peers exceeding their connection limit.
+func (g *ConnGater) Connected(n network.Network, c network.Conn) {
+	g.connectedDirection(c)
+	if c.Stat().Direction == network.DirOutbound {
+		g.dialDone(c.RemotePeer())
+	}
+
+	if g.maxConnsPerPeer > 0 {
+		conns := n.ConnsToPeer(c.RemotePeer())
+		if len(conns) > g.maxConnsPerPeer {
+			sort.Slice(conns, func(i, j int) bool {
+				return conns[i].Stat().Opened.Before(conns[j].Stat().Opened)
+			})
+			for _, old := range conns[:len(conns)-g.maxConnsPerPeer] {
+				go old.Close()
+			}
+		}
+	}
+
+	if g.maxConnsPerIPv6ASN <= 0 {
+		return
+	}
+
+	asn := asnForAddr(c.RemoteMultiaddr())
+	if asn == "" {
+		return
+	}
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	key := handshakeKey(c)
+	if _, ok := g.asnPending[key]; ok && c.Stat().Direction == network.DirInbound {
+		delete(g.asnPending, key)
+		return
+	}
+	g.asnConns[asn]++
+}
+
+// Disconnected handles the Disconnect notification and releases the
+// connection from its direction and the ASN of its remote address.
+func (g *ConnGater) Disconnected(n network.Network, c network.Conn) {
+	g.countDirection(c.Stat().Direction, -1)
+
+	if g.maxConnsPerIPv6ASN <= 0 {
+		return
+	}
+
+	asn := asnForAddr(c.RemoteMultiaddr())
+	if asn == "" {
+		return
+	}
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	g.asnConns[asn]--
+	if g.asnConns[asn] <= 0 {
+		delete(g.asnConns, asn)
+	}
+}
+
+func (g *ConnGater) countDirection(dir network.Direction, delta int) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	g.countDirectionLocked(dir, delta)
+}
+
+func (g *ConnGater) countDirectionLocked(dir network.Direction, delta int) {
+	switch dir {
+	case network.DirInbound:
+		g.inboundConns += delta
+	case network.DirOutbound:
+		g.outboundConns += delta
+	}
+}
+
+// reserveDirection reserves a pending slot under the given key for a
+// connection in the given direction, returning false if the direction has
+// reached its connection limit.
+func (g *ConnGater) reserveDirection(dir network.Direction, key string) bool {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := g.clock.Now()
+	g.expireDirectionSlots(now)
+	if slot, ok := g.dirPending[key]; ok && slot.dir == dir {
+		g.dirPending[key] = dirSlot{dir: dir, started: now}
+		return true
+	}
+
+	var allow bool
+	switch dir {
+	case network.DirInbound:
+		allow = g.maxInboundConns <= 0 || g.inboundConns < g.maxInboundConns
+	case network.DirOutbound:
+		allow = g.maxOutboundConns <= 0 || g.outboundConns < g.maxOutboundConns
+	default:
+		return true
+	}
+	if !allow {
+		return false
+	}
+
+	g.countDirectionLocked(dir, 1)
+	g.dirPending[key] = dirSlot{dir: dir, started: now}
+	return true
+}
+
+// releaseDirection releases the pending slot under the given key.
+func (g *ConnGater) releaseDirection(key string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	if slot, ok := g.dirPending[key]; ok {
+		delete(g.dirPending, key)
+		g.countDirectionLocked(slot.dir, -1)
+	}
+}
+
+// connectedDirection accounts the given connection to its direction, taking
+// over its pending slot if it has one.
+func (g *ConnGater) connectedDirection(c network.Conn) {
+	dir := c.Stat().Direction
+	key := handshakeKey(c)
+	if dir == network.DirOutbound {
+		key = dialKey(c.RemotePeer())
+	}
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	if slot, ok := g.dirPending[key]; ok && slot.dir == dir {
+		delete(g.dirPending, key)
+		return
+	}
+	g.countDirectionLocked(dir, 1)
+}
+
+// expireDirectionSlots releases the pending slots of connections that did not
+// connect within the handshake timeout.
+func (g *ConnGater) expireDirectionSlots(now time.Time) {
+	for key, slot := range g.dirPending {
+		if now.Sub(slot.started) <= handshakeTimeout {
+			continue
+		}
+
+		delete(g.dirPending, key)
+		g.countDirectionLocked(slot.dir, -1)
+	}
+}
+
+// reserveASN reserves a slot for an accepted inbound connection in the ASN
+// of its remote address, returning false if the ASN has reached its
+// connection limit.
+func (g *ConnGater) reserveASN(addrs network.ConnMultiaddrs) bool {
+	if g.maxConnsPerIPv6ASN <= 0 {
+		return true
+	}
+
+	asn := asnForAddr(addrs.RemoteMultiaddr())
+	if asn == "" {
+		return true
+	}
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := g.clock.Now()
+	g.expireASNSlots(now)
+	if g.asnConns[asn] >= g.maxConnsPerIPv6ASN {
+		return false
+	}
+
+	g.asnConns[asn]++
+	g.asnPending[handshakeKey(addrs)] = asnSlot{asn: asn, accepted: now}
+	return true
+}
+
+// expireASNSlots releases the slots of accepted connections that did not
+// connect within the handshake timeout.
+func (g *ConnGater) expireASNSlots(now time.Time) {
+	for key, slot := range g.asnPending {
+		if now.Sub(slot.accepted) <= handshakeTimeout {
+			continue
+		}
+
+		delete(g.asnPending, key)
+		g.asnConns[slot.asn]--
+		if g.asnConns[slot.asn] <= 0 {
+			delete(g.asnConns, slot.asn)
+		}
+	}
+}
+
+func (g *ConnGater) handshakeStarted(addrs network.ConnMultiaddrs) {
+	g.hsMx.Lock()
+	defer g.hsMx.Unlock()
+
+	now := g.clock.Now()
+	g.handshake[handshakeKey(addrs)] = now
+	g.sweepHandshakes(now)
+	handshakesInProgress.Set(float64(len(g.handshake)))
+}
+
+func (g *ConnGater) handshakeDone(addrs network.ConnMultiaddrs) {
+	g.hsMx.Lock()
+	defer g.hsMx.Unlock()
+
+	delete(g.handshake, handshakeKey(addrs))
+	g.sweepHandshakes(g.clock.Now())
+	handshakesInProgress.Set(float64(len(g.handshake)))
+}
+
+// sweepHandshakes expires the handshakes that have exceeded the handshake
+// timeout, at most once per second.
+func (g *ConnGater) sweepHandshakes(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Second {
+		return
+	}
+	g.lastSweep = now
+
+	for k, start := range g.handshake {
+		if now.Sub(start) > handshakeTimeout {
+			delete(g.handshake, k)
+		}
+	}
+}
+
+// dialStarted tracks a dial to the given peer, returning false if the pending
+// dial limit is reached. Concurrent dials to the same peer are one dial to the
+// swarm, and count once.
+func (g *ConnGater) dialStarted(p peer.ID) bool {
+	if g.maxPendingDials <= 0 {
+		return true
+	}
+
+	g.dialMx.Lock()
+	defer g.dialMx.Unlock()
+
+	now := g.clock.Now()
+	g.sweepDials(now)
+
+	if _, ok := g.dials[p]; !ok && len(g.dials) >= g.maxPendingDials {
+		// release the slots of the dials that failed since the last sweep
+		// before rejecting
+		g.releaseFailedDials(now)
+		if len(g.dials) >= g.maxPendingDials {
+			pendingDials.Set(float64(len(g.dials)))
+			dialsRejected.Inc()
+			return false
+		}
+	}
+
+	g.dials[p] = &pendingDial{started: now}
+	pendingDials.Set(float64(len(g.dials)))
+	return true
+}
+
+func (g *ConnGater) dialDone(p peer.ID) {
+	if g.maxPendingDials <= 0 {
+		return
+	}
+
+	g.dialMx.Lock()
+	defer g.dialMx.Unlock()
+
+	delete(g.dials, p)
+	g.sweepDials(g.clock.Now())
+	pendingDials.Set(float64(len(g.dials)))
+}
+
+// sweepDials releases the failed dials, at most once per second.
+func (g *ConnGater) sweepDials(now time.Time) {
+	if now.Sub(g.lastDialSweep) < time.Second {
+		return
+	}
+	g.releaseFailedDials(now)
+}
+
+func (g *ConnGater) releaseFailedDials(now time.Time) {
+	g.lastDialSweep = now
+
+	for p, d := range g.dials {
+		if g.dialFailed(p, d, now) {
+			delete(g.dials, p)
+		}
+	}
+}
+
+// dialFailed returns true if the given pending dial has failed: the swarm
+// has backed off from all its addresses, it dialed no address, or it has
+// exceeded the dial timeout.
+func (g *ConnGater) dialFailed(p peer.ID, d *pendingDial, now time.Time) bool {
+	if now.Sub(d.started) > network.DialPeerTimeout {
+		return true
+	}
+	if len(d.addrs) == 0 {
+		return now.Sub(d.started) > dialAddrGrace
+	}
+	if g.dialBackoff == nil {
+		return false
+	}
+
+	for _, addr := range d.addrs {
+		if !g.dialBackoff.Backoff(p, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func handshakeKey(addrs network.ConnMultiaddrs) string {
+	return addrs.LocalMultiaddr().String() + "|" + addrs.RemoteMultiaddr().String()
+}
+
+// dialKey returns the key of the pending direction slot of a dial to the
+// given peer.
+func dialKey(p peer.ID) string {
+	return "dial|" + string(p)
+}
+
+// asnForAddr returns the ASN of the given address, or the empty string if it
+// is unknown. The embedded ASN database only covers IPv6 addresses.
+func asnForAddr(addr ma.Multiaddr) string {
+	ip, err := manet.ToIP(addr)
+	if err != nil || ip.To4() != nil {
+		return ""
+	}
+
+	asn, err := asnutil.Store.AsnForIPv6(ip)
+	if err != nil {
+		return ""
+	}
+
+	return asn
+}
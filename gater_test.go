@@ -0,0 +1,406 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testConn is a connection between two addresses, of which only the
+// addresses, direction, opening time and remote peer are known.
+type testConn struct {
+	network.Conn
+
+	local, remote ma.Multiaddr
+	dir           network.Direction
+	opened        time.Time
+	peer          peer.ID
+	// closed when the connection is closed, if set
+	closed chan struct{}
+}
+
+func newTestConn(remoteIP string, port int, dir network.Direction) *testConn {
+	proto := "ip4"
+	if net.ParseIP(remoteIP).To4() == nil {
+		proto = "ip6"
+	}
+	return &testConn{
+		local:  ma.StringCast("/ip4/10.0.0.1/tcp/4001"),
+		remote: ma.StringCast(fmt.Sprintf("/%s/%s/tcp/%d", proto, remoteIP, port)),
+		dir:    dir,
+		peer:   peer.ID(fmt.Sprintf("peer-%s-%d", remoteIP, port)),
+	}
+}
+
+func (c *testConn) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *testConn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+func (c *testConn) RemotePeer() peer.ID           { return c.peer }
+func (c *testConn) Stat() network.ConnStats {
+	return network.ConnStats{Stats: network.Stats{Direction: c.dir, Opened: c.opened}}
+}
+
+func (c *testConn) Close() error {
+	if c.closed != nil {
+		close(c.closed)
+	}
+	return nil
+}
+
+func newTestGater(cfg NetworkConfig) (*ConnGater, *clock.Mock) {
+	clk := clock.NewMock()
+	g := NewConnGater(cfg)
+	g.clock = clk
+	return g, clk
+}
+
+const (
+	googlePrefixIPv6 = "2001:4860:4860::88"   // AS15169, completed by the tests
+	cloudflareIPv6   = "2606:4700:4700::1111" // AS13335
+)
+
+func TestGaterASNLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		max     int
+		remotes []string
+		want    []bool
+	}{
+		{
+			name:    "same ASN is capped",
+			max:     2,
+			remotes: []string{googlePrefixIPv6 + "88", googlePrefixIPv6 + "44", googlePrefixIPv6 + "88"},
+			want:    []bool{true, true, false},
+		},
+		{
+			name:    "distinct ASNs are counted separately",
+			max:     1,
+			remotes: []string{googlePrefixIPv6 + "88", cloudflareIPv6, googlePrefixIPv6 + "44"},
+			want:    []bool{true, true, false},
+		},
+		{
+			name:    "IPv4 is not limited",
+			max:     1,
+			remotes: []string{"8.8.8.8", "8.8.4.4", "8.8.8.8"},
+			want:    []bool{true, true, true},
+		},
+		{
+			name:    "no limit",
+			max:     0,
+			remotes: []string{googlePrefixIPv6 + "88", googlePrefixIPv6 + "44", googlePrefixIPv6 + "88"},
+			want:    []bool{true, true, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, _ := newTestGater(NetworkConfig{MaxConnsPerIPv6ASN: tc.max})
+			for i, remote := range tc.remotes {
+				c := newTestConn(remote, 1000+i, network.DirInbound)
+				if got := g.InterceptAccept(c); got != tc.want[i] {
+					t.Fatalf("accept %d from %s: got %t, want %t", i, remote, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGaterASNSlotLifecycle(t *testing.T) {
+	g, clk := newTestGater(NetworkConfig{MaxConnsPerIPv6ASN: 1})
+
+	// an accepted connection holds the slot once connected, without
+	// counting twice, until it disconnects
+	c := newTestConn(googlePrefixIPv6+"88", 1000, network.DirInbound)
+	if !g.InterceptAccept(c) {
+		t.Fatal("first connection denied")
+	}
+	g.Connected(nil, c)
+	if g.InterceptAccept(newTestConn(googlePrefixIPv6+"44", 1001, network.DirInbound)) {
+		t.Fatal("connection over the limit allowed")
+	}
+	g.Disconnected(nil, c)
+	if !g.InterceptAccept(newTestConn(googlePrefixIPv6+"44", 1002, network.DirInbound)) {
+		t.Fatal("connection denied after disconnect")
+	}
+
+	// the slot of a connection that never connects expires with the
+	// handshake timeout
+	if g.InterceptAccept(newTestConn(googlePrefixIPv6+"88", 1003, network.DirInbound)) {
+		t.Fatal("connection over the limit allowed while handshaking")
+	}
+	clk.Add(handshakeTimeout + time.Second)
+	if !g.InterceptAccept(newTestConn(googlePrefixIPv6+"88", 1004, network.DirInbound)) {
+		t.Fatal("connection denied after the handshake timeout")
+	}
+}
+
+func TestGaterASNOutbound(t *testing.T) {
+	g, _ := newTestGater(NetworkConfig{MaxConnsPerIPv6ASN: 1})
+
+	// outbound connections are not gated, but count against the limit
+	g.Connected(nil, newTestConn(googlePrefixIPv6+"88", 1000, network.DirOutbound))
+	if g.InterceptAccept(newTestConn(googlePrefixIPv6+"44", 1001, network.DirInbound)) {
+		t.Fatal("inbound connection allowed in a full ASN")
+	}
+}
+
+// testBackoff is a dial backoff of which the backed off addresses are set by
+// the tests.
+type testBackoff map[string]bool
+
+func (b testBackoff) Backoff(p peer.ID, addr ma.Multiaddr) bool {
+	return b[p.String()+addr.String()]
+}
+
+func (b testBackoff) add(p peer.ID, addr ma.Multiaddr) {
+	b[p.String()+addr.String()] = true
+}
+
+func TestGaterPendingDials(t *testing.T) {
+	addr1 := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	addr2 := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1")
+	a, b := peer.ID("a"), peer.ID("b")
+
+	for _, tc := range []struct {
+		name string
+		// dial a, within the limit, then run the steps before dialing b
+		steps func(g *ConnGater, clk *clock.Mock, backoff testBackoff)
+		want  bool
+	}{
+		{
+			name: "pending dial holds its slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				g.InterceptAddrDial(a, addr1)
+			},
+			want: false,
+		},
+		{
+			name: "failed dial releases its slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				g.InterceptAddrDial(a, addr1)
+				backoff.add(a, addr1)
+			},
+			want: true,
+		},
+		{
+			name: "dial failed on some addresses holds its slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				g.InterceptAddrDial(a, addr1)
+				g.InterceptAddrDial(a, addr2)
+				backoff.add(a, addr1)
+			},
+			want: false,
+		},
+		{
+			name: "dial without addresses releases its slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				clk.Add(dialAddrGrace + time.Second)
+			},
+			want: true,
+		},
+		{
+			name: "connected dial releases its slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				g.InterceptAddrDial(a, addr1)
+				c := newTestConn("1.2.3.4", 4001, network.DirOutbound)
+				c.peer = a
+				g.Connected(&testNetwork{}, c)
+			},
+			want: true,
+		},
+		{
+			name: "dial timeout releases the slot",
+			steps: func(g *ConnGater, clk *clock.Mock, backoff testBackoff) {
+				g.InterceptAddrDial(a, addr1)
+				clk.Add(network.DialPeerTimeout + time.Second)
+			},
+			want: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, clk := newTestGater(NetworkConfig{MaxPendingDials: 1})
+			backoff := make(testBackoff)
+			g.SetDialBackoff(backoff)
+
+			if !g.InterceptPeerDial(a) {
+				t.Fatal("first dial denied")
+			}
+			tc.steps(g, clk, backoff)
+			if got := g.InterceptPeerDial(b); got != tc.want {
+				t.Fatalf("second dial: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGaterDirectionLimits(t *testing.T) {
+	g, _ := newTestGater(NetworkConfig{MaxInboundConns: 1, MaxOutboundConns: 1})
+	n := &testNetwork{}
+
+	in := newTestConn("1.2.3.4", 1000, network.DirInbound)
+	if !g.InterceptAccept(in) {
+		t.Fatal("first inbound connection denied")
+	}
+	g.Connected(n, in)
+	if g.InterceptAccept(newTestConn("1.2.3.5", 1001, network.DirInbound)) {
+		t.Fatal("inbound connection over the limit allowed")
+	}
+
+	// the limits are separate
+	if !g.InterceptPeerDial(peer.ID("out")) {
+		t.Fatal("outbound dial denied by the inbound limit")
+	}
+	out := newTestConn("5.6.7.8", 1002, network.DirOutbound)
+	out.peer = "out"
+	g.Connected(n, out)
+	if g.InterceptPeerDial(peer.ID("other")) {
+		t.Fatal("outbound dial over the limit allowed")
+	}
+
+	g.Disconnected(n, in)
+	if !g.InterceptAccept(newTestConn("1.2.3.5", 1003, network.DirInbound)) {
+		t.Fatal("inbound connection denied after disconnect")
+	}
+	g.Disconnected(n, out)
+	if !g.InterceptPeerDial(peer.ID("other")) {
+		t.Fatal("outbound dial denied after disconnect")
+	}
+}
+
+func TestGaterDirectionSlots(t *testing.T) {
+	g, clk := newTestGater(NetworkConfig{MaxInboundConns: 1, MaxOutboundConns: 1})
+	n := &testNetwork{}
+
+	// accepted connections hold their slot before they are connected
+	in := newTestConn("1.2.3.4", 1000, network.DirInbound)
+	if !g.InterceptAccept(in) {
+		t.Fatal("first inbound connection denied")
+	}
+	if g.InterceptAccept(newTestConn("1.2.3.5", 1001, network.DirInbound)) {
+		t.Fatal("second inbound connection allowed before the first is connected")
+	}
+	g.Connected(n, in)
+	if g.InterceptAccept(newTestConn("1.2.3.5", 1001, network.DirInbound)) {
+		t.Fatal("second inbound connection allowed after the first is connected")
+	}
+	g.Disconnected(n, in)
+
+	// pending slots expire with the handshake timeout
+	if !g.InterceptAccept(newTestConn("1.2.3.6", 1002, network.DirInbound)) {
+		t.Fatal("inbound connection denied after disconnect")
+	}
+	clk.Add(handshakeTimeout + time.Second)
+	if !g.InterceptAccept(newTestConn("1.2.3.7", 1003, network.DirInbound)) {
+		t.Fatal("inbound connection denied after the pending slot expired")
+	}
+
+	// dials hold their slot before they are connected, and redials of the
+	// same peer share it
+	if !g.InterceptPeerDial(peer.ID("out")) {
+		t.Fatal("first dial denied")
+	}
+	if !g.InterceptPeerDial(peer.ID("out")) {
+		t.Fatal("redial denied")
+	}
+	if g.InterceptPeerDial(peer.ID("other")) {
+		t.Fatal("second dial allowed before the first is connected")
+	}
+	out := newTestConn("5.6.7.8", 1004, network.DirOutbound)
+	out.peer = "out"
+	g.Connected(n, out)
+	if g.InterceptPeerDial(peer.ID("other")) {
+		t.Fatal("second dial allowed after the first is connected")
+	}
+	g.Disconnected(n, out)
+	if !g.InterceptPeerDial(peer.ID("other")) {
+		t.Fatal("dial denied after disconnect")
+	}
+}
+
+func TestGaterHandshakesInProgress(t *testing.T) {
+	g, clk := newTestGater(NetworkConfig{})
+
+	a := newTestConn("1.2.3.4", 1000, network.DirInbound)
+	b := newTestConn("1.2.3.5", 1001, network.DirInbound)
+	for i, c := range []*testConn{a, b} {
+		if !g.InterceptAccept(c) {
+			t.Fatal("connection denied")
+		}
+		if got := testutil.ToFloat64(handshakesInProgress); got != float64(i+1) {
+			t.Fatalf("got %g handshakes in progress, want %d", got, i+1)
+		}
+	}
+
+	g.InterceptSecured(network.DirInbound, a.peer, a)
+	if got := testutil.ToFloat64(handshakesInProgress); got != 1 {
+		t.Fatalf("got %g handshakes in progress after securing one, want 1", got)
+	}
+
+	// outbound handshakes are not counted
+	out := newTestConn("5.6.7.8", 1002, network.DirOutbound)
+	g.InterceptSecured(network.DirOutbound, out.peer, out)
+	if got := testutil.ToFloat64(handshakesInProgress); got != 1 {
+		t.Fatalf("got %g handshakes in progress after an outbound handshake, want 1", got)
+	}
+
+	// failed handshakes are not signaled, and expire after the timeout
+	clk.Add(handshakeTimeout + time.Second)
+	if !g.InterceptAccept(newTestConn("1.2.3.6", 1003, network.DirInbound)) {
+		t.Fatal("connection denied")
+	}
+	if got := testutil.ToFloat64(handshakesInProgress); got != 1 {
+		t.Fatalf("got %g handshakes in progress after the timeout, want 1", got)
+	}
+}
+
+func TestGaterMaxConnsPerPeer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		max    int
+		conns  int
+		closed int
+	}{
+		{name: "within the limit", max: 2, conns: 2, closed: 0},
+		{name: "oldest closed beyond the limit", max: 2, conns: 4, closed: 2},
+		{name: "unlimited", max: 0, conns: 4, closed: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, clk := newTestGater(NetworkConfig{MaxConnsPerPeer: tc.max})
+
+			var conns []network.Conn
+			for i := 0; i < tc.conns; i++ {
+				c := newTestConn("1.2.3.4", 4001+i, network.DirInbound)
+				c.peer = "peer"
+				c.opened = clk.Now()
+				c.closed = make(chan struct{})
+				conns = append(conns, c)
+				clk.Add(time.Second)
+			}
+			// the newest connection is connected last, and listed first
+			listed := append([]network.Conn{conns[len(conns)-1]}, conns[:len(conns)-1]...)
+			n := &testNetwork{conns: map[peer.ID][]network.Conn{"peer": listed}}
+			g.Connected(n, conns[len(conns)-1])
+
+			for i, c := range conns {
+				closed := c.(*testConn).closed
+				if i < tc.closed {
+					select {
+					case <-closed:
+					case <-time.After(5 * time.Second):
+						t.Fatalf("connection %d not closed", i)
+					}
+					continue
+				}
+				select {
+				case <-closed:
+					t.Fatalf("connection %d closed", i)
+				default:
+				}
+			}
+		})
+	}
+}
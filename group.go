@@ -0,0 +1,108 @@
+package relaydaemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/ipns"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// ACL group records are IPNS records of an admin key, whose value is the JSON
+// list of the allowed peer IDs instead of a path. The DHT only accepts public
+// key and IPNS records, and validates the IPNS record signature on retrieval.
+
+// ParseGroupRecordKey parses a group record key of the form
+// /ipns/<admin peer ID> into the admin peer ID.
+func ParseGroupRecordKey(key string) (peer.ID, error) {
+	id, ok := strings.CutPrefix(key, "/ipns/")
+	if !ok {
+		return "", fmt.Errorf("invalid group record key: %s", key)
+	}
+
+	admin, err := peer.Decode(id)
+	if err != nil {
+		return "", fmt.Errorf("invalid group record key: %w", err)
+	}
+
+	return admin, nil
+}
+
+// SignGroupRecord returns a group record allowing the given peers, signed with
+// the given admin key and valid until eol, ready to be published to the DHT
+// under the IPNS key of the admin peer.
+func SignGroupRecord(key crypto.PrivKey, seq uint64, eol time.Time, peers []peer.ID) ([]byte, error) {
+	ids := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ids = append(ids, p.String())
+	}
+	value, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := ipns.Create(key, value, seq, eol, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := ipns.EmbedPublicKey(key.GetPublic(), entry); err != nil {
+		return nil, err
+	}
+
+	return entry.Marshal()
+}
+
+// RefreshGroup periodically resolves the group record of the given admin peer
+// from the given value store and merges its peers into the allowed peers,
+// until the context is done.
+func (a *ACLFilter) RefreshGroup(ctx context.Context, vs routing.ValueStore, admin peer.ID, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.refreshGroup(ctx, vs, admin); err != nil {
+			fmt.Printf("error refreshing ACL group record: %s\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *ACLFilter) refreshGroup(ctx context.Context, vs routing.ValueStore, admin peer.ID) error {
+	value, err := vs.GetValue(ctx, ipns.RecordKey(admin))
+	if err != nil {
+		return err
+	}
+
+	entry, err := ipns.UnmarshalIpnsEntry(value)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := json.Unmarshal(entry.GetValue(), &ids); err != nil {
+		return fmt.Errorf("error parsing group record: %w", err)
+	}
+
+	group := make(map[peer.ID]struct{}, len(ids))
+	for _, s := range ids {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return fmt.Errorf("error parsing peer ID: %w", err)
+		}
+		group[p] = struct{}{}
+	}
+
+	a.group.Store(&group)
+	a.rules.Load().cache.clear()
+	return nil
+}
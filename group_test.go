@@ -0,0 +1,122 @@
+package relaydaemon
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/ipns"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// testValueStore is a value store holding a single record.
+type testValueStore struct {
+	key   string
+	value []byte
+	err   error
+}
+
+var _ routing.ValueStore = (*testValueStore)(nil)
+
+func (vs *testValueStore) PutValue(context.Context, string, []byte, ...routing.Option) error {
+	return errors.New("read-only")
+}
+
+func (vs *testValueStore) GetValue(_ context.Context, key string, _ ...routing.Option) ([]byte, error) {
+	if vs.err != nil {
+		return nil, vs.err
+	}
+	if key != vs.key {
+		return nil, routing.ErrNotFound
+	}
+	return vs.value, nil
+}
+
+func (vs *testValueStore) SearchValue(context.Context, string, ...routing.Option) (<-chan []byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestParseGroupRecordKey(t *testing.T) {
+	admin := test.RandPeerIDFatal(t)
+	if got, err := ParseGroupRecordKey("/ipns/" + admin.String()); err != nil || got != admin {
+		t.Fatalf("got %s, %v, want %s", got, err, admin)
+	}
+
+	for _, key := range []string{admin.String(), "/ipfs/" + admin.String(), "/ipns/invalid"} {
+		if _, err := ParseGroupRecordKey(key); err == nil {
+			t.Errorf("expected an error for %s", key)
+		}
+	}
+}
+
+func TestACLRefreshGroup(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := test.RandPeerIDFatal(t)
+	member := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	acl, err := NewACL(newTestHost(), ACLConfig{AllowPeers: []string{allowed.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.AllowReserve(member, addr) {
+		t.Fatal("group member allowed before the group record is resolved")
+	}
+
+	record, err := SignGroupRecord(key, 1, time.Now().Add(time.Hour), []peer.ID{member})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := &testValueStore{key: ipns.RecordKey(admin), value: record}
+	if err := acl.refreshGroup(context.Background(), vs, admin); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[peer.ID]bool{allowed: true, member: true, other: false} {
+		if got := acl.AllowReserve(p, addr); got != want {
+			t.Errorf("%s: got %t, want %t", p, got, want)
+		}
+	}
+
+	// failed refreshes keep the group
+	vs.err = errors.New("lookup failed")
+	if err := acl.refreshGroup(context.Background(), vs, admin); err == nil {
+		t.Fatal("expected an error")
+	}
+	vs.err = nil
+	vs.value = []byte("not a record")
+	if err := acl.refreshGroup(context.Background(), vs, admin); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !acl.AllowReserve(member, addr) {
+		t.Fatal("group member denied after a failed refresh")
+	}
+
+	// a new record replaces the group
+	record, err = SignGroupRecord(key, 2, time.Now().Add(time.Hour), []peer.ID{other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.value = record
+	if err := acl.refreshGroup(context.Background(), vs, admin); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[peer.ID]bool{allowed: true, member: false, other: true} {
+		if got := acl.AllowReserve(p, addr); got != want {
+			t.Errorf("%s: got %t, want %t", p, got, want)
+		}
+	}
+}
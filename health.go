@@ -0,0 +1,187 @@
+package relaydaemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// HealthReport summarizes the health of the daemon.
+type HealthReport struct {
+	Ready        bool    `json:"ready"`
+	Peers        int     `json:"peers"`
+	Reservations int     `json:"reservations"`
+	Reachability string  `json:"reachability"`
+	Uptime       float64 `json:"uptime"`
+}
+
+// HealthReporter tracks the health of the daemon.
+type HealthReporter struct {
+	clock  clock.Clock
+	host   host.Host
+	tracer *MetricsTracer
+	start  time.Time
+
+	mx           sync.Mutex
+	reachability network.Reachability
+	// whether readiness waits for a DHT routing table refresh, and whether
+	// one has completed
+	requireDHTRefresh bool
+	dhtRefreshed      bool
+}
+
+// dhtRefreshRetryInterval is the interval at which failed DHT routing table
+// refreshes are retried while readiness waits for one.
+const dhtRefreshRetryInterval = 30 * time.Second
+
+// NewHealthReporter returns a health reporter for the given host, using the
+// given relay metrics tracer for reservation counts.
+func NewHealthReporter(ctx context.Context, h host.Host, tracer *MetricsTracer) (*HealthReporter, error) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return nil, err
+	}
+
+	clk := clock.New()
+	r := &HealthReporter{
+		clock:  clk,
+		host:   h,
+		tracer: tracer,
+		start:  clk.Now(),
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e := <-sub.Out():
+				r.mx.Lock()
+				r.reachability = e.(event.EvtLocalReachabilityChanged).Reachability
+				r.mx.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// RequireDHTRefresh makes the daemon ready only once the DHT routing table
+// has been refreshed, so that it is not reported ready with an empty table.
+// The refresh is triggered with the given function, which returns the result
+// as dht.IpfsDHT.RefreshRoutingTable does, and retried until it succeeds or
+// the context is done.
+func (r *HealthReporter) RequireDHTRefresh(ctx context.Context, refresh func() <-chan error) {
+	r.mx.Lock()
+	r.requireDHTRefresh = true
+	r.mx.Unlock()
+
+	Go("dht_refresh", func() {
+		for {
+			select {
+			case err := <-refresh():
+				if err == nil {
+					r.mx.Lock()
+					r.dhtRefreshed = true
+					r.mx.Unlock()
+					Infof("DHT routing table refreshed\n")
+					return
+				}
+				fmt.Printf("error refreshing DHT routing table: %s\n", err)
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-r.clock.After(dhtRefreshRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// Report returns the current health report. The daemon is ready once it
+// listens on at least one address and, if required, the DHT routing table has
+// been refreshed.
+func (r *HealthReporter) Report() HealthReport {
+	r.mx.Lock()
+	reachability := r.reachability
+	dhtReady := !r.requireDHTRefresh || r.dhtRefreshed
+	r.mx.Unlock()
+
+	return HealthReport{
+		Ready:        dhtReady && len(r.host.Network().ListenAddresses()) > 0,
+		Peers:        len(r.host.Network().Peers()),
+		Reservations: r.tracer.Reservations(),
+		Reachability: reachability.String(),
+		Uptime:       r.clock.Since(r.start).Seconds(),
+	}
+}
+
+// ServeHTTP responds with the health report as JSON, with status 503 Service
+// Unavailable until the daemon is ready.
+func (r *HealthReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := r.Report()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// WriteReports periodically writes the health report as JSON to the given
+// path until the context is done. The file is replaced atomically, so readers
+// never see a partial report.
+func (r *HealthReporter) WriteReports(ctx context.Context, path string, interval time.Duration) {
+	ticker := r.clock.Ticker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeFileAtomic(path, r.Report()); err != nil {
+			fmt.Printf("error writing health report: %s\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeFileAtomic writes v as JSON to a temporary file next to the given path
+// and renames it over the path.
+func writeFileAtomic(path string, v any) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,165 @@
+package relaydaemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestHealthReporterWriteReports(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newLoopbackHost(t)
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+	health, err := NewHealthReporter(ctx, h, tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewMock()
+	health.clock = clk
+	health.start = clk.Now()
+
+	const interval = time.Minute
+	path := filepath.Join(t.TempDir(), "health.json")
+	go health.WriteReports(ctx, path, interval)
+
+	// read returns the report once written
+	read := func() (map[string]any, bool) {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report map[string]any
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		return report, true
+	}
+
+	var report map[string]any
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		var ok bool
+		if report, ok = read(); ok {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("health report not written")
+		}
+	}
+	for _, field := range []string{"ready", "peers", "reservations", "reachability", "uptime"} {
+		if _, ok := report[field]; !ok {
+			t.Errorf("report without %s: %v", field, report)
+		}
+	}
+	if report["ready"] != true || report["peers"] != 0.0 || report["reservations"] != 0.0 || report["reachability"] != "Unknown" || report["uptime"] != 0.0 {
+		t.Fatalf("unexpected report: %v", report)
+	}
+
+	// the ticker may not be running yet, so tick until the report is updated
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		clk.Add(interval)
+		if report, _ = read(); report["uptime"].(float64) >= interval.Seconds() {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("health report not updated")
+		}
+	}
+}
+
+func TestHealthReporterReadyDHTRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newLoopbackHost(t)
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+	health, err := NewHealthReporter(ctx, h, tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewMock()
+	health.clock = clk
+
+	// the stub DHT completes each refresh with the result sent by the test
+	results := make(chan error)
+	refresh := func() <-chan error {
+		ch := make(chan error, 1)
+		select {
+		case err := <-results:
+			ch <- err
+		case <-ctx.Done():
+		}
+		return ch
+	}
+
+	ready := func() bool {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		health.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report HealthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Ready != (w.Code == http.StatusOK) {
+			t.Fatalf("ready %t with status %d", report.Ready, w.Code)
+		}
+		if !report.Ready && w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+		return report.Ready
+	}
+
+	if !ready() {
+		t.Fatal("not ready without requiring a DHT refresh")
+	}
+
+	health.RequireDHTRefresh(ctx, refresh)
+	if ready() {
+		t.Fatal("ready before the DHT refresh")
+	}
+
+	results <- errors.New("empty routing table")
+	if ready() {
+		t.Fatal("ready after a failed DHT refresh")
+	}
+
+	// the refresh is retried after the retry interval
+	for start := time.Now(); ; {
+		clk.Add(dhtRefreshRetryInterval)
+		select {
+		case results <- nil:
+		case <-time.After(10 * time.Millisecond):
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("DHT refresh not retried")
+			}
+			continue
+		}
+		break
+	}
+	for start := time.Now(); !ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("not ready after the DHT refresh")
+		}
+	}
+
+	// only GET is allowed
+	w := httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
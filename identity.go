@@ -2,11 +2,16 @@ package relaydaemon
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"os"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/record"
 	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/sha3"
 )
@@ -17,7 +22,7 @@ func LoadIdentity(idPath string) (crypto.PrivKey, error) {
 	if _, err := os.Stat(idPath); err == nil {
 		return ReadIdentity(idPath)
 	} else if os.IsNotExist(err) {
-		fmt.Printf("Generating peer identity in %s\n", idPath)
+		Infof("Generating peer identity in %s\n", idPath)
 		return GenerateIdentity(idPath)
 	} else {
 		return nil, err
@@ -34,6 +39,26 @@ func ReadIdentity(path string) (crypto.PrivKey, error) {
 	return crypto.UnmarshalPrivateKey(bytes)
 }
 
+// CheckIdentity checks that the private key at the given path is readable and
+// matches the identity of the running peer. The identity of a running daemon
+// never changes, so this is only used to warn about problems on reload.
+func CheckIdentity(path string, id peer.ID) error {
+	privk, err := ReadIdentity(path)
+	if err != nil {
+		return err
+	}
+
+	fileID, err := peer.IDFromPrivateKey(privk)
+	if err != nil {
+		return err
+	}
+	if fileID != id {
+		return fmt.Errorf("identity file is for %s, a restart is needed to use it", fileID)
+	}
+
+	return nil
+}
+
 // GenerateIdentity writes a new random private key to the given path.
 func GenerateIdentity(path string) (crypto.PrivKey, error) {
 	privk, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
@@ -92,3 +117,87 @@ func LoadSwarmKey(path string) (pnet.PSK, PNetFingerprint, error) {
 
 	return psk, pnetFingerprint(psk), nil
 }
+
+// SelectSwarmKey loads the swarm key at the given path and, during a swarm key
+// rotation, the next swarm key of the given relay daemon network config. Both
+// keys are validated, and the one selected by ActiveSwarmKey ("current" or
+// "next") is returned.
+func SelectSwarmKey(path string, cfg NetworkConfig) (pnet.PSK, PNetFingerprint, error) {
+	if cfg.SwarmKeyNextPath == "" {
+		return LoadSwarmKey(path)
+	}
+
+	psk, fprint, err := LoadSwarmKey(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading current swarm key: %w", err)
+	}
+	nextPsk, nextFprint, err := LoadSwarmKey(cfg.SwarmKeyNextPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading next swarm key: %w", err)
+	}
+
+	switch cfg.ActiveSwarmKey {
+	case "", "current":
+		return psk, fprint, nil
+	case "next":
+		return nextPsk, nextFprint, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown active swarm key: %s", cfg.ActiveSwarmKey)
+	}
+}
+
+// PeerRecordInfo is the signed peer record of the relay, as a base64 encoded
+// envelope along with the decoded record.
+type PeerRecordInfo struct {
+	Envelope string   `json:"envelope"`
+	PeerID   peer.ID  `json:"peer_id"`
+	Seq      uint64   `json:"seq"`
+	Addrs    []string `json:"addrs"`
+}
+
+// SignedPeerRecord returns the signed peer record of the given host, as
+// advertised over identify. If the host has not certified its addresses yet,
+// a record of its current addresses is signed with its private key.
+func SignedPeerRecord(h host.Host) (*PeerRecordInfo, error) {
+	var env *record.Envelope
+	if cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore()); ok {
+		env = cab.GetPeerRecord(h.ID())
+	}
+	if env == nil {
+		sk := h.Peerstore().PrivKey(h.ID())
+		if sk == nil {
+			return nil, fmt.Errorf("no private key for %s", h.ID())
+		}
+		rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		var err error
+		env, err = record.Seal(rec, sk)
+		if err != nil {
+			return nil, fmt.Errorf("error signing peer record: %w", err)
+		}
+	}
+
+	data, err := env.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling peer record: %w", err)
+	}
+
+	r, err := env.Record()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding peer record: %w", err)
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		return nil, fmt.Errorf("unexpected record type %T", r)
+	}
+
+	info := &PeerRecordInfo{
+		Envelope: base64.StdEncoding.EncodeToString(data),
+		PeerID:   rec.PeerID,
+		Seq:      rec.Seq,
+	}
+	for _, a := range rec.Addrs {
+		info.Addrs = append(info.Addrs, a.String())
+	}
+
+	return info, nil
+}
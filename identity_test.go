@@ -0,0 +1,129 @@
+package relaydaemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// writeSwarmKey writes a random swarm key to a file in the given directory,
+// returning its path.
+func writeSwarmKey(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	data := "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSelectSwarmKey(t *testing.T) {
+	dir := t.TempDir()
+	current := writeSwarmKey(t, dir, "swarm.key")
+	next := writeSwarmKey(t, dir, "swarm.key.next")
+	invalid := filepath.Join(dir, "invalid.key")
+	if err := os.WriteFile(invalid, []byte("not a swarm key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, currentFprint, err := LoadSwarmKey(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nextFprint, err := LoadSwarmKey(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(currentFprint, nextFprint) {
+		t.Fatal("distinct keys share a fingerprint")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     NetworkConfig
+		want    PNetFingerprint
+		wantErr bool
+	}{
+		{name: "no rotation", want: currentFprint},
+		{name: "current by default", cfg: NetworkConfig{SwarmKeyNextPath: next}, want: currentFprint},
+		{name: "current", cfg: NetworkConfig{SwarmKeyNextPath: next, ActiveSwarmKey: "current"}, want: currentFprint},
+		{name: "next", cfg: NetworkConfig{SwarmKeyNextPath: next, ActiveSwarmKey: "next"}, want: nextFprint},
+		{name: "unknown selector", cfg: NetworkConfig{SwarmKeyNextPath: next, ActiveSwarmKey: "previous"}, wantErr: true},
+		{name: "invalid next key", cfg: NetworkConfig{SwarmKeyNextPath: invalid}, wantErr: true},
+		{name: "missing next key", cfg: NetworkConfig{SwarmKeyNextPath: filepath.Join(dir, "missing.key")}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			psk, fprint, err := SelectSwarmKey(current, tc.cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(psk) != 32 {
+				t.Fatalf("got a %d byte key", len(psk))
+			}
+			if !bytes.Equal(fprint, tc.want) {
+				t.Fatalf("got fingerprint %x, want %x", fprint, tc.want)
+			}
+		})
+	}
+
+	if _, _, err := SelectSwarmKey(invalid, NetworkConfig{SwarmKeyNextPath: next, ActiveSwarmKey: "next"}); err == nil {
+		t.Fatal("expected an error for an invalid current key")
+	}
+}
+
+func TestCheckIdentity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "identity")
+	privk, err := GenerateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(privk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(dir, "other")
+	if _, err := GenerateIdentity(other); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid")
+	if err := os.WriteFile(invalid, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "running identity", path: path},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "other identity", path: other, wantErr: true},
+		{name: "invalid", path: invalid, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := CheckIdentity(tc.path, id); (err != nil) != tc.wantErr {
+				t.Fatalf("error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
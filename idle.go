@@ -0,0 +1,151 @@
+package relaydaemon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxIdleCheckInterval is the maximum interval between checks for idle
+// reservations.
+const maxIdleCheckInterval = time.Minute
+
+// IdleReservations wraps a relay ACL, revoking the reservations through which
+// no circuit is opened within a timeout after they are granted, so that peers
+// that never relay anything do not hold slots. A reservation is revoked by
+// disconnecting its peer, which frees the slot in the relay.
+type IdleReservations struct {
+	relayv2.ACLFilter
+
+	clock   clock.Clock
+	host    host.Host
+	tracer  *MetricsTracer
+	timeout time.Duration
+
+	mx sync.Mutex
+	// destinations of allowed circuit requests, until the circuit is
+	// established or the request times out
+	pending map[peer.ID]time.Time
+	// reserved peers through which a circuit was opened
+	active map[peer.ID]struct{}
+}
+
+// NewIdleReservations returns an idle reservations ACL wrapping the given ACL,
+// for a relay on the given host whose reservations are tracked by the given
+// metrics tracer.
+func NewIdleReservations(acl relayv2.ACLFilter, h host.Host, tracer *MetricsTracer, timeout time.Duration) *IdleReservations {
+	i := &IdleReservations{
+		ACLFilter: acl,
+		clock:     clock.New(),
+		host:      h,
+		tracer:    tracer,
+		timeout:   timeout,
+		pending:   make(map[peer.ID]time.Time),
+		active:    make(map[peer.ID]struct{}),
+	}
+	tracer.observeCircuits(i.circuitEstablished)
+	return i
+}
+
+// AllowConnect defers to the wrapped ACL and tracks the destination of the
+// circuit if it is allowed, until the circuit is established.
+func (i *IdleReservations) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) (allow bool) {
+	defer recoverPanic("acl_connect")
+
+	if !i.ACLFilter.AllowConnect(src, srcAddr, dest) {
+		return false
+	}
+
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	if _, ok := i.active[dest]; !ok {
+		i.pending[dest] = i.clock.Now()
+	}
+	return true
+}
+
+// circuitEstablished marks the reservations of the pending destinations with
+// an open circuit as active. The relay does not report the peers of the
+// circuit, but tags both ends of its open circuits.
+func (i *IdleReservations) circuitEstablished() {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	now := i.clock.Now()
+	for p, requested := range i.pending {
+		if now.Sub(requested) > relayv2.ConnectTimeout {
+			delete(i.pending, p)
+			continue
+		}
+
+		info := i.host.ConnManager().GetTagInfo(p)
+		if info == nil {
+			continue
+		}
+		if _, ok := info.Tags[RelayHopTag]; ok {
+			delete(i.pending, p)
+			i.active[p] = struct{}{}
+		}
+	}
+}
+
+// Run periodically revokes idle reservations until the context is done.
+func (i *IdleReservations) Run(ctx context.Context) {
+	interval := i.timeout / 2
+	if interval > maxIdleCheckInterval {
+		interval = maxIdleCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.revokeIdle()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (i *IdleReservations) revokeIdle() {
+	peers := ReservedPeers(i.host)
+
+	i.mx.Lock()
+	reserved := make(map[peer.ID]struct{}, len(peers))
+	var idle []peer.ID
+	for _, p := range peers {
+		reserved[p] = struct{}{}
+		if _, ok := i.active[p]; ok {
+			continue
+		}
+		granted := i.tracer.Granted(p)
+		if !granted.IsZero() && i.clock.Now().Sub(granted) > i.timeout {
+			idle = append(idle, p)
+		}
+	}
+	for p := range i.active {
+		if _, ok := reserved[p]; !ok {
+			delete(i.active, p)
+		}
+	}
+	for p := range i.pending {
+		if _, ok := reserved[p]; !ok {
+			delete(i.pending, p)
+		}
+	}
+	i.mx.Unlock()
+
+	for _, p := range idle {
+		Infof("Revoking the reservation of %s, through which no circuit was opened\n", p)
+		i.host.Network().ClosePeer(p)
+		idleReservationsRevoked.Inc()
+	}
+}
@@ -0,0 +1,78 @@
+package relaydaemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestIdleReservations(t *testing.T) {
+	const timeout = 10 * time.Minute
+	src := peer.ID("src")
+
+	for _, tc := range []struct {
+		name string
+		// circuit requests to the reserved peer, and whether they succeed
+		circuits []bool
+		revoked  bool
+	}{
+		{name: "no circuit", revoked: true},
+		{name: "established circuit", circuits: []bool{true}, revoked: false},
+		{name: "failed circuit", circuits: []bool{false}, revoked: true},
+		{name: "failed then established circuit", circuits: []bool{false, true}, revoked: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			clk := clock.NewMock()
+			tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{})
+			tracer.clock = clk
+			idle := NewIdleReservations(testACL{allow: true}, h, tracer, timeout)
+			idle.clock = clk
+
+			p := peer.ID("reserved")
+			h.reserve(p)
+			tracer.ReservationAllowed(false)
+
+			for _, ok := range tc.circuits {
+				if !idle.AllowConnect(src, nil, p) {
+					t.Fatal("circuit denied")
+				}
+				if ok {
+					h.cm.TagPeer(p, RelayHopTag, 2)
+					tracer.ConnectionRequestHandled(pbv2.Status_OK)
+					h.cm.UntagPeer(p, RelayHopTag)
+				} else {
+					tracer.ConnectionRequestHandled(pbv2.Status_CONNECTION_FAILED)
+				}
+			}
+
+			// a circuit to the peer established past the connect timeout
+			// of the failed requests, without a request of its own through
+			// this ACL, does not count
+			clk.Add(relayv2.ConnectTimeout + time.Second)
+			h.cm.TagPeer(p, RelayHopTag, 2)
+			tracer.ConnectionRequestHandled(pbv2.Status_OK)
+			h.cm.UntagPeer(p, RelayHopTag)
+
+			idle.revokeIdle()
+			if len(h.net.closed) > 0 {
+				t.Fatal("reservation revoked before the timeout")
+			}
+
+			clk.Add(timeout)
+			idle.revokeIdle()
+			var want []peer.ID
+			if tc.revoked {
+				want = []peer.ID{p}
+			}
+			if !reflect.DeepEqual(h.net.closed, want) {
+				t.Fatalf("revoked %v, want %v", h.net.closed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// Limiter is a resource manager limiter reading its limits from a JSON limits
+// file, whose limits can be reloaded at runtime without a restart.
+type Limiter struct {
+	cfg DaemonConfig
+
+	mx      sync.RWMutex
+	limiter rcmgr.Limiter
+}
+
+var _ rcmgr.Limiter = (*Limiter)(nil)
+
+// LimitsReport describes how reloaded limits were applied.
+type LimitsReport struct {
+	// Live are the scopes whose limits were updated in place.
+	Live []string
+	// NewScopes are the kinds of scopes whose limits only apply to scopes
+	// created after the reload.
+	NewScopes []string
+	// Restart are the scopes whose limits only apply after a restart.
+	Restart []string
+}
+
+// ScopeStatus is the current usage and limits of a resource manager scope.
+type ScopeStatus struct {
+	Usage network.ScopeStat
+	Limit rcmgr.BaseLimit
+}
+
+// ResourceStatus is the current usage and limits of the resource manager.
+type ResourceStatus struct {
+	System    ScopeStatus
+	Transient ScopeStatus
+	Services  map[string]ScopeStatus
+	Protocols map[protocol.ID]ScopeStatus
+}
+
+// NewLimiter returns a limiter using the limits in the JSON file given by the
+// relay daemon config, over the auto-scaled default limits with the
+// configured DHT and relay memory limits applied.
+func NewLimiter(cfg DaemonConfig) (*Limiter, error) {
+	l := &Limiter{cfg: cfg}
+
+	limiter, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.limiter = limiter
+
+	return l, nil
+}
+
+func (l *Limiter) load() (rcmgr.Limiter, error) {
+	defaults := rcmgr.DefaultLimits.AutoScale()
+
+	// isolate the DHT and relay workloads, so that one can't starve the other
+	var scoped rcmgr.PartialLimitConfig
+	if l.cfg.DHTMemoryLimit > 0 {
+		scoped.Protocol = map[protocol.ID]rcmgr.ResourceLimits{
+			dht.ProtocolDHT: {Memory: rcmgr.LimitVal64(l.cfg.DHTMemoryLimit)},
+		}
+	}
+	if l.cfg.RelayMemoryLimit > 0 {
+		scoped.Service = map[string]rcmgr.ResourceLimits{
+			relayv2.ServiceName: {Memory: rcmgr.LimitVal64(l.cfg.RelayMemoryLimit)},
+		}
+	}
+	defaults = scoped.Build(defaults)
+
+	if l.cfg.LimitsPath == "" {
+		return rcmgr.NewFixedLimiter(defaults), nil
+	}
+
+	f, err := os.Open(l.cfg.LimitsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limiter, err := rcmgr.NewLimiterFromJSON(f, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing limits: %w", err)
+	}
+
+	return limiter, nil
+}
+
+// Reload rereads the limits file and applies the new limits to the given
+// resource manager, updating the limits of its existing scopes in place
+// where possible.
+func (l *Limiter) Reload(rm network.ResourceManager) (LimitsReport, error) {
+	limiter, err := l.load()
+	if err != nil {
+		return LimitsReport{}, err
+	}
+
+	l.mx.Lock()
+	l.limiter = limiter
+	l.mx.Unlock()
+
+	report := LimitsReport{
+		NewScopes: []string{"service-peer", "protocol-peer", "conn", "stream"},
+		Restart:   []string{"allowlisted-system", "allowlisted-transient"},
+	}
+
+	apply := func(name string, scope any, limit rcmgr.Limit) {
+		if s, ok := scope.(rcmgr.ResourceScopeLimiter); ok {
+			s.SetLimit(limit)
+			report.Live = append(report.Live, name)
+		}
+	}
+
+	rm.ViewSystem(func(s network.ResourceScope) error {
+		apply("system", s, limiter.GetSystemLimits())
+		return nil
+	})
+	rm.ViewTransient(func(s network.ResourceScope) error {
+		apply("transient", s, limiter.GetTransientLimits())
+		return nil
+	})
+
+	state, ok := rm.(rcmgr.ResourceManagerState)
+	if !ok {
+		return report, nil
+	}
+
+	for _, svc := range state.ListServices() {
+		rm.ViewService(svc, func(s network.ServiceScope) error {
+			apply("service:"+svc, s, limiter.GetServiceLimits(svc))
+			return nil
+		})
+	}
+	for _, proto := range state.ListProtocols() {
+		rm.ViewProtocol(proto, func(s network.ProtocolScope) error {
+			apply("protocol:"+string(proto), s, limiter.GetProtocolLimits(proto))
+			return nil
+		})
+	}
+	for _, p := range state.ListPeers() {
+		rm.ViewPeer(p, func(s network.PeerScope) error {
+			apply("peer:"+p.String(), s, limiter.GetPeerLimits(p))
+			return nil
+		})
+	}
+
+	return report, nil
+}
+
+// Status returns the current usage of the given resource manager against the
+// current limits.
+func (l *Limiter) Status(rm network.ResourceManager) (ResourceStatus, error) {
+	state, ok := rm.(rcmgr.ResourceManagerState)
+	if !ok {
+		return ResourceStatus{}, fmt.Errorf("resource manager does not expose its state")
+	}
+
+	limiter := l.current()
+	stat := state.Stat()
+
+	status := ResourceStatus{
+		System:    ScopeStatus{Usage: stat.System, Limit: baseLimit(limiter.GetSystemLimits())},
+		Transient: ScopeStatus{Usage: stat.Transient, Limit: baseLimit(limiter.GetTransientLimits())},
+		Services:  make(map[string]ScopeStatus, len(stat.Services)),
+		Protocols: make(map[protocol.ID]ScopeStatus, len(stat.Protocols)),
+	}
+	for svc, usage := range stat.Services {
+		status.Services[svc] = ScopeStatus{Usage: usage, Limit: baseLimit(limiter.GetServiceLimits(svc))}
+	}
+	for proto, usage := range stat.Protocols {
+		status.Protocols[proto] = ScopeStatus{Usage: usage, Limit: baseLimit(limiter.GetProtocolLimits(proto))}
+	}
+
+	return status, nil
+}
+
+func baseLimit(l rcmgr.Limit) rcmgr.BaseLimit {
+	return rcmgr.BaseLimit{
+		Streams:         l.GetStreamTotalLimit(),
+		StreamsInbound:  l.GetStreamLimit(network.DirInbound),
+		StreamsOutbound: l.GetStreamLimit(network.DirOutbound),
+		Conns:           l.GetConnTotalLimit(),
+		ConnsInbound:    l.GetConnLimit(network.DirInbound),
+		ConnsOutbound:   l.GetConnLimit(network.DirOutbound),
+		FD:              l.GetFDLimit(),
+		Memory:          l.GetMemoryLimit(),
+	}
+}
+
+func (l *Limiter) current() rcmgr.Limiter {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	return l.limiter
+}
+
+// The methods below implement rcmgr.Limiter using the current limits.
+
+func (l *Limiter) GetSystemLimits() rcmgr.Limit {
+	return l.current().GetSystemLimits()
+}
+
+func (l *Limiter) GetTransientLimits() rcmgr.Limit {
+	return l.current().GetTransientLimits()
+}
+
+func (l *Limiter) GetAllowlistedSystemLimits() rcmgr.Limit {
+	return l.current().GetAllowlistedSystemLimits()
+}
+
+func (l *Limiter) GetAllowlistedTransientLimits() rcmgr.Limit {
+	return l.current().GetAllowlistedTransientLimits()
+}
+
+func (l *Limiter) GetServiceLimits(svc string) rcmgr.Limit {
+	return l.current().GetServiceLimits(svc)
+}
+
+func (l *Limiter) GetServicePeerLimits(svc string) rcmgr.Limit {
+	return l.current().GetServicePeerLimits(svc)
+}
+
+func (l *Limiter) GetProtocolLimits(proto protocol.ID) rcmgr.Limit {
+	return l.current().GetProtocolLimits(proto)
+}
+
+func (l *Limiter) GetProtocolPeerLimits(proto protocol.ID) rcmgr.Limit {
+	return l.current().GetProtocolPeerLimits(proto)
+}
+
+func (l *Limiter) GetPeerLimits(p peer.ID) rcmgr.Limit {
+	return l.current().GetPeerLimits(p)
+}
+
+func (l *Limiter) GetStreamLimits(p peer.ID) rcmgr.Limit {
+	return l.current().GetStreamLimits(p)
+}
+
+func (l *Limiter) GetConnLimits() rcmgr.Limit {
+	return l.current().GetConnLimits()
+}
+
+// StreamRejections is a resource manager trace reporter counting the streams
+// rejected by the resource manager, by the scope that blocked them.
+type StreamRejections struct{}
+
+var _ rcmgr.TraceReporter = StreamRejections{}
+
+// ConsumeEvent counts stream rejections.
+func (StreamRejections) ConsumeEvent(evt rcmgr.TraceEvt) {
+	if evt.Type != rcmgr.TraceBlockAddStreamEvt {
+		return
+	}
+
+	counterWith(streamRejected, "stream_rejected", streamScopeClass(evt.Name)).Inc()
+}
+
+// streamScopeClass returns the class of the named resource manager scope,
+// without peer IDs or span IDs that would make the label unbounded: "system",
+// "transient", "peer", "service:<name>" or "protocol:<id>".
+func streamScopeClass(name string) string {
+	if i := strings.Index(name, ".peer:"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, ".span-"); i >= 0 {
+		name = name[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(name, "peer:"):
+		return "peer"
+	case strings.HasPrefix(name, "conn-"):
+		return "conn"
+	case strings.HasPrefix(name, "stream-"):
+		return "stream"
+	}
+	return name
+}
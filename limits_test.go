@@ -0,0 +1,161 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestStreamScopeClass(t *testing.T) {
+	for _, tc := range []struct {
+		scope string
+		want  string
+	}{
+		{scope: "system", want: "system"},
+		{scope: "transient", want: "transient"},
+		{scope: "peer:12D3KooWETr1NNvq8P4SnTeNirjonLpjjb3fxgtzZdwQAsAewXsN", want: "peer"},
+		{scope: "service:libp2p.relay/v2", want: "service:libp2p.relay/v2"},
+		{scope: "service:libp2p.relay/v2.peer:12D3KooWETr1NNvq8P4SnTeNirjonLpjjb3fxgtzZdwQAsAewXsN", want: "service:libp2p.relay/v2"},
+		{scope: "protocol:/libp2p/circuit/relay/0.2.0/hop", want: "protocol:/libp2p/circuit/relay/0.2.0/hop"},
+		{scope: "protocol:/ipfs/id/1.0.0.peer:12D3KooWETr1NNvq8P4SnTeNirjonLpjjb3fxgtzZdwQAsAewXsN", want: "protocol:/ipfs/id/1.0.0"},
+		{scope: "service:libp2p.relay/v2.span-42", want: "service:libp2p.relay/v2"},
+		{scope: "conn-17", want: "conn"},
+		{scope: "stream-123", want: "stream"},
+	} {
+		if got := streamScopeClass(tc.scope); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.scope, got, tc.want)
+		}
+	}
+}
+
+func TestLimiterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	writeLimits := func(conns int) {
+		t.Helper()
+		limits := fmt.Sprintf(`{"System": {"Conns": %d, "ConnsInbound": %d}}`, conns, conns)
+		if err := os.WriteFile(path, []byte(limits), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLimits(100)
+	l, err := NewLimiter(DaemonConfig{LimitsPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := rcmgr.NewResourceManager(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	first, err := rm.OpenConnection(network.DirInbound, true, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Done()
+
+	writeLimits(1)
+	report, err := l.Reload(rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := false
+	for _, scope := range report.Live {
+		if scope == "system" {
+			live = true
+		}
+	}
+	if !live {
+		t.Fatalf("expected the system limits to be applied live, got %v", report.Live)
+	}
+
+	status, err := l.Status(rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.System.Limit.Conns != 1 {
+		t.Fatalf("got a system connection limit of %d, want 1", status.System.Limit.Conns)
+	}
+
+	// the reloaded limit applies to the existing system scope
+	if _, err := rm.OpenConnection(network.DirInbound, true, addr); err == nil {
+		t.Fatal("expected the reloaded limit to reject a second connection")
+	}
+}
+
+func TestLimiterReloadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	if err := os.WriteFile(path, []byte(`{"System": {"Conns": 10}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLimiter(DaemonConfig{LimitsPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := rcmgr.NewResourceManager(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+
+	if err := os.WriteFile(path, []byte(`{"System": `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reload(rm); err == nil {
+		t.Fatal("expected an error reloading invalid limits")
+	}
+	if got := l.GetSystemLimits().GetConnTotalLimit(); got != 10 {
+		t.Fatalf("got a system connection limit of %d after a failed reload, want 10", got)
+	}
+}
+
+func TestLimiterScopeMemoryLimits(t *testing.T) {
+	l, err := NewLimiter(DaemonConfig{DHTMemoryLimit: 32 << 20, RelayMemoryLimit: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.GetProtocolLimits(dht.ProtocolDHT).GetMemoryLimit(); got != 32<<20 {
+		t.Fatalf("got a DHT protocol memory limit of %d, want %d", got, 32<<20)
+	}
+	if got := l.GetServiceLimits(relayv2.ServiceName).GetMemoryLimit(); got != 64<<20 {
+		t.Fatalf("got a relay service memory limit of %d, want %d", got, 64<<20)
+	}
+
+	// other scopes keep the default limits
+	defaults := rcmgr.NewFixedLimiter(rcmgr.DefaultLimits.AutoScale())
+	if got, want := l.GetSystemLimits().GetMemoryLimit(), defaults.GetSystemLimits().GetMemoryLimit(); got != want {
+		t.Fatalf("got a system memory limit of %d, want %d", got, want)
+	}
+}
+
+func TestLimiterScopeMemoryLimitsFromFile(t *testing.T) {
+	// the limits file takes precedence over the configured scope limits
+	path := filepath.Join(t.TempDir(), "limits.json")
+	limits := fmt.Sprintf(`{"Service": {%q: {"Memory": %d}}}`, relayv2.ServiceName, 16<<20)
+	if err := os.WriteFile(path, []byte(limits), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLimiter(DaemonConfig{LimitsPath: path, DHTMemoryLimit: 32 << 20, RelayMemoryLimit: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.GetServiceLimits(relayv2.ServiceName).GetMemoryLimit(); got != 16<<20 {
+		t.Fatalf("got a relay service memory limit of %d, want %d", got, 16<<20)
+	}
+	if got := l.GetProtocolLimits(dht.ProtocolDHT).GetMemoryLimit(); got != 32<<20 {
+		t.Fatalf("got a DHT protocol memory limit of %d, want %d", got, 32<<20)
+	}
+}
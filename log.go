@@ -0,0 +1,63 @@
+package relaydaemon
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+var quiet atomic.Bool
+
+// SetQuiet enables or disables quiet mode, in which informational messages,
+// such as the startup banners, are suppressed; warnings and errors are still
+// printed.
+func SetQuiet(q bool) {
+	quiet.Store(q)
+}
+
+// Infof prints an informational message, unless in quiet mode.
+func Infof(format string, args ...any) {
+	if quiet.Load() {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// logLimiter limits a log message to once per second; the zero value is ready
+// to use.
+type logLimiter struct {
+	last atomic.Int64
+}
+
+// allow returns true if the message may be logged at the given time.
+func (l *logLimiter) allow(now time.Time) bool {
+	last := l.last.Load()
+	if now.UnixNano()-last < int64(time.Second) {
+		return false
+	}
+	return l.last.CompareAndSwap(last, now.UnixNano())
+}
+
+// LogSummary periodically prints a summary line of the relay activity, with
+// the bytes relayed since the previous summary, until the context is done.
+func LogSummary(ctx context.Context, interval time.Duration, h host.Host, tracer *MetricsTracer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastBytes := tracer.TotalBytes()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		totalBytes := tracer.TotalBytes()
+		Infof("Summary: reservations=%d circuits=%d connections=%d peers=%d bytes_relayed=%d\n",
+			tracer.Reservations(), tracer.Circuits(), len(h.Network().Conns()), len(h.Network().Peers()), totalBytes-lastBytes)
+		lastBytes = totalBytes
+	}
+}
@@ -0,0 +1,136 @@
+package relaydaemon
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestQuiet(t *testing.T) {
+	h := newTestHost()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	h.net.ps = ps
+	c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newLoopbackHost(t)
+	health, err := NewHealthReporter(ctx, relay, NewMetricsTracer(nopRelayTracer{}, relay, relayv2.Resources{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// logs an informational message and, as writing the health report to a
+	// missing directory fails, an error
+	logAll := func() string {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		return captureOutput(t, func() {
+			Infof("informational\n")
+			LogConnectionAddrs(h.net, c)
+			health.WriteReports(canceled, filepath.Join(t.TempDir(), "missing", "health.json"), 1)
+		})
+	}
+
+	out := logAll()
+	for _, want := range []string{"informational", "Connected to", "error writing health report"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+
+	SetQuiet(true)
+	defer SetQuiet(false)
+
+	out = logAll()
+	for _, info := range []string{"informational", "Connected to"} {
+		if strings.Contains(out, info) {
+			t.Errorf("informational message %q printed in quiet mode: %q", info, out)
+		}
+	}
+	if !strings.Contains(out, "error writing health report") {
+		t.Errorf("error not printed in quiet mode: %q", out)
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	h := newTestHost()
+	h.net.conns = make(map[peer.ID][]network.Conn)
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+
+	// two connections to a reserved peer and a connection to another peer
+	reserved, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{reserved, reserved, other} {
+		c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+		c.peer = p
+		h.net.conns[p] = append(h.net.conns[p], c)
+		h.net.connected[p] = true
+	}
+	h.reserve(reserved)
+	tracer.ReservationAllowed(false)
+	tracer.ConnectionOpened()
+	// relayed before the summaries started
+	tracer.BytesTransferred(100)
+
+	const interval = 100 * time.Millisecond
+	summarize := func(d time.Duration, relayed int) []string {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := captureOutput(t, func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				LogSummary(ctx, interval, h, tracer)
+			}()
+
+			time.Sleep(interval / 2)
+			tracer.BytesTransferred(relayed)
+			time.Sleep(d - interval/2)
+			cancel()
+			<-done
+		})
+		return strings.Fields(out)
+	}
+
+	if out := summarize(interval*3/4, 0); len(out) > 0 {
+		t.Fatalf("summary logged before the interval: %q", out)
+	}
+
+	out := summarize(interval*7/2, 50)
+	if len(out)%6 != 0 {
+		t.Fatalf("unexpected summaries: %q", out)
+	}
+	if n := len(out) / 6; n < 2 || n > 4 {
+		t.Fatalf("%d summaries logged in 3.5 intervals: %q", n, out)
+	}
+	var relayed int
+	for i := 0; i < len(out); i += 6 {
+		want := []string{"Summary:", "reservations=1", "circuits=1", "connections=3", "peers=2"}
+		if got := out[i : i+5]; strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("summary %q, want %q", got, want)
+		}
+		var n int
+		if _, err := fmt.Sscanf(out[i+5], "bytes_relayed=%d", &n); err != nil {
+			t.Fatal(err)
+		}
+		relayed += n
+	}
+	// the bytes relayed are counted once, since the summaries started
+	if relayed != 50 {
+		t.Fatalf("%d bytes relayed in the summaries, want 50", relayed)
+	}
+}
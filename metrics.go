@@ -0,0 +1,255 @@
+package relaydaemon
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricNamespace = "relayd"
+
+var (
+	warmingUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "warming_up",
+		Help:      "Whether the daemon is within its metrics warmup period",
+	})
+
+	dhtMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dht_mode",
+		Help:      "The effective DHT mode, set to 1 for the active mode",
+	}, []string{"mode"})
+
+	handshakesInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "handshakes_in_progress",
+		Help:      "Number of inbound connections accepted but not yet secured",
+	})
+
+	pendingDials = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "pending_dials",
+		Help:      "Number of outbound dials in progress, if limited",
+	})
+
+	dialsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "dials_rejected_total",
+		Help:      "Number of outbound dials rejected over the pending dial limit",
+	})
+
+	connMgrLowWatermark = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "connmgr_low_watermark",
+		Help:      "The configured connection manager low watermark",
+	})
+	connMgrHighWatermark = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "connmgr_high_watermark",
+		Help:      "The configured connection manager high watermark",
+	})
+
+	aclObservedDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "acl_observed_denials_total",
+		Help:      "Number of ACL decisions that would have been denied in observe mode",
+	}, []string{"op", "reason"})
+
+	aclReloadDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "acl_reload_disconnects_total",
+		Help:      "Number of peers with reservations disconnected because an ACL update denied them",
+	})
+
+	reservationUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "reservation_utilization",
+		Help:      "Ratio of active reservations to the maximum number of reservations",
+	})
+
+	reservingSubnets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "reserving_subnets",
+		Help:      "Number of distinct /24 (IPv4) and /64 (IPv6) subnets of peers with active reservations",
+	})
+
+	oldestReservationAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "oldest_reservation_age_seconds",
+		Help:      "Age of the oldest active reservation, including its renewals",
+	})
+
+	reservationsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "reservations_rejected_total",
+		Help:      "Number of reservations rejected by the relay daemon",
+	}, []string{"reason"})
+
+	idleReservationsRevoked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "idle_reservations_revoked_total",
+		Help:      "Number of reservations revoked for opening no circuit",
+	})
+
+	streamRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "stream_rejected_total",
+		Help:      "Number of streams rejected by the resource manager, by blocking scope",
+	}, []string{"scope"})
+
+	connectDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "connect_denied_total",
+		Help:      "Number of relay connections denied by the relay daemon",
+	}, []string{"reason"})
+
+	malformedStreams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "malformed_streams_total",
+		Help:      "Number of relay requests rejected as malformed, by request type",
+	}, []string{"request"})
+
+	handlerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "handler_panics_total",
+		Help:      "Number of panics recovered in relay daemon handlers",
+	}, []string{"handler"})
+
+	metricsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "metrics_dropped_total",
+		Help:      "Number of metric updates dropped because they would exceed the maximum number of series",
+	})
+
+	collectors = []prometheus.Collector{
+		warmingUp,
+		dhtMode,
+		handshakesInProgress,
+		pendingDials,
+		dialsRejected,
+		connMgrLowWatermark,
+		connMgrHighWatermark,
+		aclObservedDenials,
+		aclReloadDisconnects,
+		reservationUtilization,
+		reservingSubnets,
+		oldestReservationAge,
+		reservationsRejected,
+		streamRejected,
+		idleReservationsRevoked,
+		connectDenied,
+		malformedStreams,
+		handlerPanics,
+		metricsDropped,
+	}
+
+	series = seriesGuard{seen: make(map[string]struct{})}
+
+	// unregistered metrics receiving the dropped updates
+	discardedCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"})
+	discardedGauge   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "discarded"})
+)
+
+// MustRegisterWith registers all relay daemon metrics with the given registerer.
+func MustRegisterWith(reg prometheus.Registerer) {
+	reg.MustRegister(collectors...)
+}
+
+// seriesGuard bounds the number of series of the labeled relay daemon
+// metrics.
+type seriesGuard struct {
+	mx   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+// SetMaxMetricSeries sets the maximum number of series of the labeled relay
+// daemon metrics; updates of new series beyond it are dropped and counted in
+// relayd_metrics_dropped_total. Zero or less disables the limit.
+func SetMaxMetricSeries(max int) {
+	series.mx.Lock()
+	defer series.mx.Unlock()
+
+	series.max = max
+}
+
+// allow returns true if the series of the named metric with the given label
+// values exists or can be created.
+func (g *seriesGuard) allow(name string, lvs []string) bool {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	key := name + "\xff" + strings.Join(lvs, "\xff")
+	if _, ok := g.seen[key]; ok {
+		return true
+	}
+	if g.max > 0 && len(g.seen) >= g.max {
+		metricsDropped.Inc()
+		return false
+	}
+
+	g.seen[key] = struct{}{}
+	return true
+}
+
+// counterWith returns the counter of the named counter vec with the given
+// label values, or a discarded counter if it would exceed the series limit.
+func counterWith(vec *prometheus.CounterVec, name string, lvs ...string) prometheus.Counter {
+	if !series.allow(name, lvs) {
+		return discardedCounter
+	}
+	return vec.WithLabelValues(lvs...)
+}
+
+// gaugeWith returns the gauge of the named gauge vec with the given label
+// values, or a discarded gauge if it would exceed the series limit.
+func gaugeWith(vec *prometheus.GaugeVec, name string, lvs ...string) prometheus.Gauge {
+	if !series.allow(name, lvs) {
+		return discardedGauge
+	}
+	return vec.WithLabelValues(lvs...)
+}
+
+// StartMetricsWarmup marks the daemon as warming up until the given duration
+// has elapsed, so that alerts on noisy startup metrics can be suppressed.
+func StartMetricsWarmup(d time.Duration) {
+	startMetricsWarmup(clock.New(), d)
+}
+
+func startMetricsWarmup(clk clock.Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	warmingUp.Set(1)
+	clk.AfterFunc(d, func() {
+		warmingUp.Set(0)
+	})
+}
+
+// SetConnMgrWatermarks exports the connection manager watermarks of the
+// given config; they are zero if the connection manager is disabled.
+func SetConnMgrWatermarks(cfg ConnMgrConfig) {
+	if cfg.Disabled {
+		connMgrLowWatermark.Set(0)
+		connMgrHighWatermark.Set(0)
+		return
+	}
+
+	connMgrLowWatermark.Set(float64(cfg.ConnMgrLo))
+	connMgrHighWatermark.Set(float64(cfg.ConnMgrHi))
+}
+
+func setDHTMode(mode string) {
+	for _, m := range []string{"server", "client"} {
+		if m == mode {
+			gaugeWith(dhtMode, "dht_mode", m).Set(1)
+		} else {
+			gaugeWith(dhtMode, "dht_mode", m).Set(0)
+		}
+	}
+}
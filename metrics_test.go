@@ -0,0 +1,107 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsWarmup(t *testing.T) {
+	clk := clock.NewMock()
+	startMetricsWarmup(clk, time.Minute)
+
+	for _, step := range []struct {
+		advance time.Duration
+		want    float64
+	}{
+		{0, 1},
+		{59 * time.Second, 1},
+		{time.Second, 0},
+	} {
+		clk.Add(step.advance)
+		if got := testutil.ToFloat64(warmingUp); got != step.want {
+			t.Fatalf("warming up after %s: got %g, want %g", step.advance, got, step.want)
+		}
+	}
+}
+
+func TestConnMgrWatermarks(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     ConnMgrConfig
+		low, hi float64
+	}{
+		{name: "configured", cfg: ConnMgrConfig{ConnMgrLo: 512, ConnMgrHi: 768}, low: 512, hi: 768},
+		{name: "disabled", cfg: ConnMgrConfig{ConnMgrLo: 512, ConnMgrHi: 768, Disabled: true}, low: 0, hi: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			SetConnMgrWatermarks(tc.cfg)
+			if got := testutil.ToFloat64(connMgrLowWatermark); got != tc.low {
+				t.Errorf("low watermark: got %g, want %g", got, tc.low)
+			}
+			if got := testutil.ToFloat64(connMgrHighWatermark); got != tc.hi {
+				t.Errorf("high watermark: got %g, want %g", got, tc.hi)
+			}
+		})
+	}
+}
+
+func TestSeriesGuard(t *testing.T) {
+	g := &seriesGuard{max: 2, seen: make(map[string]struct{})}
+	dropped := testutil.ToFloat64(metricsDropped)
+
+	for _, step := range []struct {
+		name string
+		lvs  []string
+		want bool
+	}{
+		{name: "a", lvs: []string{"x"}, want: true},
+		{name: "a", lvs: []string{"y"}, want: true},
+		{name: "a", lvs: []string{"x"}, want: true},
+		{name: "a", lvs: []string{"z"}, want: false},
+		{name: "b", lvs: []string{"x"}, want: false},
+		{name: "a", lvs: []string{"y"}, want: true},
+	} {
+		if got := g.allow(step.name, step.lvs); got != step.want {
+			t.Fatalf("%s%v: got %t, want %t", step.name, step.lvs, got, step.want)
+		}
+	}
+	if got := testutil.ToFloat64(metricsDropped); got != dropped+2 {
+		t.Fatalf("%g dropped updates counted, want 2", got-dropped)
+	}
+}
+
+func TestMaxMetricSeries(t *testing.T) {
+	// start from no series, so that the test can be repeated
+	series.mx.Lock()
+	seen := series.seen
+	series.seen = make(map[string]struct{})
+	series.mx.Unlock()
+	defer func() {
+		series.mx.Lock()
+		series.seen = seen
+		series.mx.Unlock()
+	}()
+	SetMaxMetricSeries(1)
+	defer SetMaxMetricSeries(0)
+
+	counters := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"label"})
+	gauges := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test"}, []string{"label"})
+	counterWith(counters, "test_series", "first").Inc()
+	counterWith(counters, "test_series", "second").Inc()
+	gaugeWith(gauges, "test_gauge", "first").Set(1)
+	counterWith(counters, "test_series", "first").Inc()
+
+	if got := testutil.CollectAndCount(counters); got != 1 {
+		t.Fatalf("%d counter series, want 1", got)
+	}
+	if got := testutil.ToFloat64(counters.WithLabelValues("first")); got != 2 {
+		t.Fatalf("counter %g, want 2", got)
+	}
+	if got := testutil.CollectAndCount(gauges); got != 0 {
+		t.Fatalf("%d gauge series, want 0", got)
+	}
+}
@@ -0,0 +1,27 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Go runs f in a new goroutine; a panic in f is logged with its stack and
+// counted, instead of crashing the daemon.
+func Go(name string, f func()) {
+	go func() {
+		defer recoverPanic(name)
+		f()
+	}()
+}
+
+// recoverPanic recovers from a panic in the named handler, logging it with its
+// stack and counting it. It must be called directly by defer.
+func recoverPanic(name string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	fmt.Printf("panic in %s: %v\n%s", name, r, debug.Stack())
+	counterWith(handlerPanics, "handler_panics", name).Inc()
+}
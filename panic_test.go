@@ -0,0 +1,62 @@
+package relaydaemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	panics := testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "test_handler"))
+	out := captureOutput(t, func() {
+		func() {
+			defer recoverPanic("test_handler")
+			panic("boom")
+		}()
+	})
+	if !strings.Contains(out, "panic in test_handler: boom") || !strings.Contains(out, "goroutine") {
+		t.Fatalf("panic not logged with its stack: %q", out)
+	}
+	if got := testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "test_handler")); got != panics+1 {
+		t.Fatalf("%g panics counted, want 1", got-panics)
+	}
+}
+
+func TestGoRecoversPanics(t *testing.T) {
+	panics := testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "test_loop"))
+
+	// the panic is counted once logged
+	out := captureOutput(t, func() {
+		Go("test_loop", func() { panic("boom") })
+
+		for start := time.Now(); testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "test_loop")) != panics+1; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("panic not counted")
+			}
+		}
+	})
+	if !strings.Contains(out, "panic in test_loop: boom") {
+		t.Fatalf("panic not logged: %q", out)
+	}
+}
+
+func TestACLPanicDenies(t *testing.T) {
+	panics := testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "acl_reserve"))
+
+	// an ACL without rules panics
+	acl := &ACLFilter{}
+	var allowed bool
+	captureOutput(t, func() {
+		allowed = acl.AllowReserve(test.RandPeerIDFatal(t), ma.StringCast("/ip4/1.2.3.4/tcp/4001"))
+	})
+	if allowed {
+		t.Fatal("reservation allowed after a panic")
+	}
+	if got := testutil.ToFloat64(counterWith(handlerPanics, "handler_panics", "acl_reserve")); got != panics+1 {
+		t.Fatalf("%g panics counted, want 1", got-panics)
+	}
+}
@@ -0,0 +1,43 @@
+package relaydaemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ProbeRelay checks that a deployed relay works end to end, by making a
+// reservation on it with the given client host and then dialing the target
+// peer through it. It returns the time it took to establish the relayed
+// connection. The client host must have the relay transport enabled.
+func ProbeRelay(ctx context.Context, h host.Host, relay peer.AddrInfo, target peer.ID) (time.Duration, error) {
+	if err := h.Connect(ctx, relay); err != nil {
+		return 0, fmt.Errorf("error connecting to relay: %w", err)
+	}
+
+	if _, err := client.Reserve(ctx, h, relay); err != nil {
+		return 0, fmt.Errorf("error making reservation: %w", err)
+	}
+
+	circuit, err := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit", relay.ID))
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	err = h.Connect(network.WithUseTransient(ctx, "relay probe"), peer.AddrInfo{
+		ID:    target,
+		Addrs: []ma.Multiaddr{circuit},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error connecting to target through relay: %w", err)
+	}
+
+	return time.Since(start), nil
+}
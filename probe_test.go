@@ -0,0 +1,88 @@
+package relaydaemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// newLoopbackHost returns a host listening on a random loopback TCP port.
+func newLoopbackHost(t *testing.T) host.Host {
+	t.Helper()
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestProbeRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relay := newLoopbackHost(t)
+	r, err := relayv2.New(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+
+	target := newLoopbackHost(t)
+	if err := target.Connect(ctx, relayInfo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, target, relayInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	probe, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	if _, err := ProbeRelay(ctx, probe, relayInfo, target.ID()); err != nil {
+		t.Fatalf("probe failed: %s", err)
+	}
+	if conns := probe.Network().ConnsToPeer(target.ID()); len(conns) == 0 {
+		t.Fatal("expected the probe to be connected to the target")
+	}
+}
+
+func TestProbeRelayNoReservation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relay := newLoopbackHost(t)
+	r, err := relayv2.New(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+
+	// the target is known to the relay, but holds no reservation
+	target := newLoopbackHost(t)
+	if err := target.Connect(ctx, relayInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	probe, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	if _, err := ProbeRelay(ctx, probe, relayInfo, target.ID()); err == nil {
+		t.Fatal("expected the probe to fail without a reservation")
+	}
+}
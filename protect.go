@@ -0,0 +1,167 @@
+package relaydaemon
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// destinationProtectTag is the connection manager protection tag for the
+	// busiest relayed destinations.
+	destinationProtectTag = "relayd-destination"
+	// destinationProtectInterval is the interval at which the protected
+	// destinations are recomputed; circuit counts are halved on every
+	// interval, so that the ranking follows recent activity.
+	destinationProtectInterval = time.Minute
+)
+
+// DestinationProtector wraps a relay ACL, counting the established circuits
+// to each destination peer and protecting the busiest destinations in the
+// connection manager, so that they stay connected.
+type DestinationProtector struct {
+	relayv2.ACLFilter
+
+	clock clock.Clock
+	cm    connmgr.ConnManager
+	n     int
+
+	mx sync.Mutex
+	// allowed circuit requests, in order, until the circuit is established
+	// or the request times out
+	pending   []circuitRequest
+	circuits  map[peer.ID]float64
+	protected map[peer.ID]struct{}
+}
+
+type circuitRequest struct {
+	dest      peer.ID
+	requested time.Time
+}
+
+// NewDestinationProtector returns a destination protector wrapping the given
+// ACL, which protects the top n destinations in the given connection manager,
+// counting the circuits established by the relay whose metrics are tracked
+// by the given tracer.
+func NewDestinationProtector(acl relayv2.ACLFilter, cm connmgr.ConnManager, tracer *MetricsTracer, n int) *DestinationProtector {
+	d := &DestinationProtector{
+		ACLFilter: acl,
+		clock:     clock.New(),
+		cm:        cm,
+		n:         n,
+		circuits:  make(map[peer.ID]float64),
+		protected: make(map[peer.ID]struct{}),
+	}
+	tracer.observeCircuits(d.circuitEstablished)
+	return d
+}
+
+// AllowConnect defers to the wrapped ACL and tracks the allowed circuit
+// requests, until their circuit is established.
+func (d *DestinationProtector) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) (allow bool) {
+	defer recoverPanic("acl_connect")
+
+	if !d.ACLFilter.AllowConnect(src, srcAddr, dest) {
+		return false
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.pending = append(d.pending, circuitRequest{dest: dest, requested: d.clock.Now()})
+	return true
+}
+
+// circuitEstablished counts an established circuit against the destination
+// of the oldest pending request with an open circuit. The relay does not
+// report the peers of the circuit, but tags both ends of its open circuits.
+func (d *DestinationProtector) circuitEstablished() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	now := d.clock.Now()
+	pending := d.pending[:0]
+	counted := false
+	for _, req := range d.pending {
+		if now.Sub(req.requested) > relayv2.ConnectTimeout {
+			continue
+		}
+		if !counted && hasTag(d.cm, req.dest, RelayHopTag) {
+			d.circuits[req.dest]++
+			counted = true
+			continue
+		}
+		pending = append(pending, req)
+	}
+	d.pending = pending
+}
+
+// Run periodically protects the busiest destinations until the context is
+// done.
+func (d *DestinationProtector) Run(ctx context.Context) {
+	ticker := d.clock.Ticker(destinationProtectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.protectTop()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *DestinationProtector) protectTop() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	dests := make([]peer.ID, 0, len(d.circuits))
+	for p := range d.circuits {
+		dests = append(dests, p)
+	}
+	sort.Slice(dests, func(i, j int) bool {
+		return d.circuits[dests[i]] > d.circuits[dests[j]]
+	})
+	if len(dests) > d.n {
+		dests = dests[:d.n]
+	}
+
+	top := make(map[peer.ID]struct{}, len(dests))
+	for _, p := range dests {
+		top[p] = struct{}{}
+		if _, ok := d.protected[p]; !ok {
+			d.cm.Protect(p, destinationProtectTag)
+		}
+	}
+	for p := range d.protected {
+		if _, ok := top[p]; !ok {
+			d.cm.Unprotect(p, destinationProtectTag)
+		}
+	}
+	d.protected = top
+
+	now := d.clock.Now()
+	pending := d.pending[:0]
+	for _, req := range d.pending {
+		if now.Sub(req.requested) <= relayv2.ConnectTimeout {
+			pending = append(pending, req)
+		}
+	}
+	d.pending = pending
+
+	for p, cnt := range d.circuits {
+		if cnt < 1 {
+			delete(d.circuits, p)
+		} else {
+			d.circuits[p] = cnt / 2
+		}
+	}
+}
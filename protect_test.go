@@ -0,0 +1,119 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// protectConnMgr is a tag connection manager recording protections.
+type protectConnMgr struct {
+	*TagConnMgr
+	protected map[peer.ID]bool
+}
+
+func (cm *protectConnMgr) Protect(p peer.ID, tag string) {
+	cm.protected[p] = true
+}
+
+func (cm *protectConnMgr) Unprotect(p peer.ID, tag string) bool {
+	delete(cm.protected, p)
+	return false
+}
+
+func TestDestinationProtector(t *testing.T) {
+	src := peer.ID("src")
+	busy := peer.ID("busy")
+	quiet := peer.ID("quiet")
+	failing := peer.ID("failing")
+
+	h := newTestHost()
+	cm := &protectConnMgr{TagConnMgr: h.cm, protected: make(map[peer.ID]bool)}
+	clk := clock.NewMock()
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{})
+	d := NewDestinationProtector(testACL{allow: true}, cm, tracer, 1)
+	d.clock = clk
+
+	circuit := func(dest peer.ID, ok bool) {
+		t.Helper()
+		if !d.AllowConnect(src, nil, dest) {
+			t.Fatal("circuit denied")
+		}
+		if !ok {
+			tracer.ConnectionRequestHandled(pbv2.Status_CONNECTION_FAILED)
+			return
+		}
+		h.cm.TagPeer(dest, RelayHopTag, 2)
+		tracer.ConnectionRequestHandled(pbv2.Status_OK)
+		h.cm.UntagPeer(dest, RelayHopTag)
+	}
+
+	// allowed circuits that fail are not counted, however many
+	for i := 0; i < 5; i++ {
+		circuit(failing, false)
+	}
+	circuit(busy, true)
+	circuit(busy, true)
+	circuit(quiet, true)
+
+	d.protectTop()
+	if !cm.protected[busy] || len(cm.protected) != 1 {
+		t.Fatalf("protected %v, want only %s", cm.protected, busy)
+	}
+
+	// the failed requests expire, and do not count towards later circuits
+	clk.Add(relayv2.ConnectTimeout + time.Second)
+	h.cm.TagPeer(failing, RelayHopTag, 2)
+	tracer.ConnectionRequestHandled(pbv2.Status_OK)
+	h.cm.UntagPeer(failing, RelayHopTag)
+	if len(d.pending) != 0 {
+		t.Fatalf("%d requests still pending", len(d.pending))
+	}
+
+	// the ranking follows recent activity
+	for i := 0; i < 4; i++ {
+		circuit(quiet, true)
+	}
+	d.protectTop()
+	if !cm.protected[quiet] || len(cm.protected) != 1 {
+		t.Fatalf("protected %v, want only %s", cm.protected, quiet)
+	}
+}
+
+func TestDestinationProtectorCountsOnce(t *testing.T) {
+	src := peer.ID("src")
+	a := peer.ID("a")
+	b := peer.ID("b")
+
+	h := newTestHost()
+	cm := &protectConnMgr{TagConnMgr: h.cm, protected: make(map[peer.ID]bool)}
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{})
+	d := NewDestinationProtector(testACL{allow: true}, cm, tracer, 2)
+
+	// concurrent requests to two destinations with open circuits; each
+	// established circuit counts for one request
+	for _, dest := range []peer.ID{a, b, a} {
+		if !d.AllowConnect(src, nil, dest) {
+			t.Fatal("circuit denied")
+		}
+	}
+	h.cm.TagPeer(a, RelayHopTag, 2)
+	h.cm.TagPeer(b, RelayHopTag, 2)
+	tracer.ConnectionRequestHandled(pbv2.Status_OK)
+	tracer.ConnectionRequestHandled(pbv2.Status_OK)
+
+	var total float64
+	for _, cnt := range d.circuits {
+		total += cnt
+	}
+	if total != 2 {
+		t.Fatalf("counted %g circuits, want 2", total)
+	}
+	if d.circuits[a] != 1 || d.circuits[b] != 1 {
+		t.Fatalf("counted %v, want one circuit for each destination in request order", d.circuits)
+	}
+}
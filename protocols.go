@@ -0,0 +1,203 @@
+package relaydaemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ProtocolHider keeps protocols served by a host out of its Identify
+// responses. Identify advertises the protocols registered with the host, so
+// the handlers of the hidden protocols are unregistered and served instead
+// through the Identify handler, which matches them in addition to Identify.
+type ProtocolHider struct {
+	host host.Host
+	sub  event.Subscription
+
+	// serializes updates
+	update sync.Mutex
+
+	mx sync.RWMutex
+	// original Identify handler
+	identify protocol.HandlerFunc
+	// handlers of the hidden protocols, nil until registered
+	hidden map[protocol.ID]protocol.HandlerFunc
+	// hidden protocol whose handler is being looked up
+	lookup protocol.ID
+}
+
+// HideProtocols hides the given protocols from the Identify responses of the
+// given host, while still serving them. Protocols registered later, such as
+// the DHT protocol when the DHT switches to server mode, are hidden by Run.
+func HideProtocols(h host.Host, protos []string) (*ProtocolHider, error) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalProtocolsUpdated))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProtocolHider{
+		host:   h,
+		sub:    sub,
+		hidden: make(map[protocol.ID]protocol.HandlerFunc, len(protos)),
+	}
+	added := []protocol.ID{identify.ID}
+	for _, proto := range protos {
+		p.hidden[protocol.ID(proto)] = nil
+		added = append(added, protocol.ID(proto))
+	}
+	if err := p.protocolsAdded(added); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Run hides the hidden protocols again whenever they are registered, until
+// the context is canceled.
+func (p *ProtocolHider) Run(ctx context.Context) {
+	defer p.sub.Close()
+
+	for {
+		select {
+		case e, ok := <-p.sub.Out():
+			if !ok {
+				return
+			}
+			if err := p.protocolsAdded(e.(event.EvtLocalProtocolsUpdated).Added); err != nil {
+				fmt.Printf("error hiding protocols: %s\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// protocolsAdded takes over the handlers of the given newly registered
+// protocols, if hidden, and unregisters them. A newly registered Identify
+// handler replaces the handler serving the hidden protocols, which is then
+// registered again.
+func (p *ProtocolHider) protocolsAdded(added []protocol.ID) error {
+	p.update.Lock()
+	defer p.update.Unlock()
+
+	var (
+		hide      []protocol.ID
+		reinstall bool
+	)
+	for _, proto := range added {
+		if proto == identify.ID {
+			handler, err := lookupHandler(p.host.Mux(), proto)
+			if err != nil {
+				return fmt.Errorf("error looking up the identify handler: %w", err)
+			}
+			p.mx.Lock()
+			p.identify = handler
+			p.mx.Unlock()
+			reinstall = true
+			continue
+		}
+
+		p.mx.Lock()
+		_, ok := p.hidden[proto]
+		if ok {
+			// a previous handler of the protocol may still be served
+			// through Identify, which must not match the lookup
+			p.lookup = proto
+		}
+		p.mx.Unlock()
+		if !ok {
+			continue
+		}
+
+		handler, err := lookupHandler(p.host.Mux(), proto)
+		p.mx.Lock()
+		p.lookup = ""
+		if err == nil {
+			p.hidden[proto] = handler
+		}
+		p.mx.Unlock()
+		if err == nil {
+			hide = append(hide, proto)
+		}
+	}
+
+	if len(hide) > 0 || reinstall {
+		p.host.Mux().AddHandlerWithFunc(identify.ID, p.match, p.handle)
+	}
+	// unregistering the handlers updates the protocols advertised by
+	// Identify
+	for _, proto := range hide {
+		p.host.RemoveStreamHandler(proto)
+	}
+
+	return nil
+}
+
+// match returns whether the given protocol is Identify or a registered
+// hidden protocol.
+func (p *ProtocolHider) match(proto protocol.ID) bool {
+	if proto == identify.ID {
+		return true
+	}
+
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+
+	return p.hidden[proto] != nil && proto != p.lookup
+}
+
+// handle dispatches streams to the Identify handler or to the handler of the
+// hidden protocol.
+func (p *ProtocolHider) handle(proto protocol.ID, rwc io.ReadWriteCloser) error {
+	p.mx.RLock()
+	handler := p.identify
+	if proto != identify.ID {
+		handler = p.hidden[proto]
+	}
+	p.mx.RUnlock()
+
+	if handler == nil {
+		if s, ok := rwc.(network.Stream); ok {
+			s.Reset()
+		}
+		return fmt.Errorf("no handler for protocol %s", proto)
+	}
+	return handler(proto, rwc)
+}
+
+// lookupHandler returns the handler that the given protocol switch
+// negotiates for the given protocol.
+func lookupHandler(mux protocol.Switch, proto protocol.ID) (protocol.HandlerFunc, error) {
+	var req []byte
+	for _, tok := range []string{msmux.ProtocolID, string(proto)} {
+		req = binary.AppendUvarint(req, uint64(len(tok)+1))
+		req = append(req, tok+"\n"...)
+	}
+
+	_, handler, err := mux.Negotiate(negotiation{bytes.NewReader(req)})
+	if err != nil {
+		return nil, fmt.Errorf("protocol %s is not registered: %w", proto, err)
+	}
+	return handler, nil
+}
+
+// negotiation is a protocol negotiation read from a buffer, discarding the
+// responses.
+type negotiation struct {
+	io.Reader
+}
+
+func (negotiation) Write(b []byte) (int, error) { return len(b), nil }
+
+func (negotiation) Close() error { return nil }
@@ -0,0 +1,132 @@
+package relaydaemon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+)
+
+func TestHideProtocols(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const (
+		visible = protocol.ID("/test/visible/1.0.0")
+		hidden  = protocol.ID("/test/hidden/1.0.0")
+		later   = protocol.ID("/test/later/1.0.0")
+	)
+	reply := func(msg string) network.StreamHandler {
+		return func(s network.Stream) {
+			defer s.Close()
+			s.Write([]byte(msg))
+		}
+	}
+
+	relay := newLoopbackHost(t)
+	relay.SetStreamHandler(visible, reply("visible"))
+	relay.SetStreamHandler(hidden, reply("hidden"))
+
+	hider, err := HideProtocols(relay, []string{string(hidden), string(later)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hider.Run(ctx)
+
+	// identify runs when connecting
+	identified := func(t *testing.T) host.Host {
+		t.Helper()
+
+		h := newLoopbackHost(t)
+		if err := h.Connect(ctx, peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+		protos, err := h.Peerstore().GetProtocols(relay.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		advertised := make(map[protocol.ID]bool)
+		for _, proto := range protos {
+			advertised[proto] = true
+		}
+		if !advertised[identify.ID] || !advertised[visible] {
+			t.Fatalf("protocols %v, want %s and %s", protos, identify.ID, visible)
+		}
+		if advertised[hidden] || advertised[later] {
+			t.Fatalf("hidden protocol advertised: %v", protos)
+		}
+		return h
+	}
+	request := func(t *testing.T, h host.Host, proto protocol.ID, want string) {
+		t.Helper()
+
+		s, err := h.NewStream(ctx, relay.ID(), proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		b, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("reply %q, want %q", b, want)
+		}
+	}
+	hiddenFromMux := func(t *testing.T) {
+		t.Helper()
+
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			registered := false
+			for _, proto := range relay.Mux().Protocols() {
+				if proto == hidden || proto == later {
+					registered = true
+				}
+			}
+			if !registered {
+				return
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("protocols registered again are not hidden")
+			}
+		}
+	}
+
+	t.Run("hidden", func(t *testing.T) {
+		h := identified(t)
+		request(t, h, visible, "visible")
+		request(t, h, hidden, "hidden")
+	})
+
+	t.Run("registered again", func(t *testing.T) {
+		relay.SetStreamHandler(hidden, reply("hidden again"))
+		relay.SetStreamHandler(later, reply("later"))
+		hiddenFromMux(t)
+
+		h := identified(t)
+
+		// identify is still served by its own handler
+		s, err := h.NewStream(ctx, relay.ID(), identify.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		b, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, []byte(visible)) || bytes.Contains(b, []byte(hidden)) {
+			t.Fatalf("unexpected identify response: %q", b)
+		}
+
+		request(t, h, hidden, "hidden again")
+		request(t, h, later, "later")
+	})
+}
@@ -0,0 +1,199 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	// DefaultRateLimitTier is the name of the rate limit tier applying to
+	// the peers that match no other tier.
+	DefaultRateLimitTier = "default"
+	// rateLimitSweepInterval is the minimum interval between sweeps of the
+	// buckets that have refilled.
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateLimitTier is a parsed rate limit tier, limiting the reservation
+// requests of each of its peers with a token bucket.
+type rateLimitTier struct {
+	clock    clock.Clock
+	name     string
+	peers    map[peer.ID]struct{}
+	subnets  []*net.IPNet
+	interval time.Duration
+	burst    int
+
+	mx        sync.Mutex
+	buckets   map[peer.ID]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitTiers are the rate limit tiers of an ACL config; the tiers are
+// matched in name order, and peers matching none of them fall in the default
+// tier, if any.
+type rateLimitTiers struct {
+	tiers []*rateLimitTier
+	def   *rateLimitTier
+}
+
+func parseRateLimitTiers(cfg map[string]RateLimitTier) (*rateLimitTiers, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tiers := &rateLimitTiers{}
+	for _, name := range names {
+		tier, err := parseRateLimitTier(name, cfg[name])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rate limit tier %s: %w", name, err)
+		}
+
+		if name == DefaultRateLimitTier {
+			if len(tier.peers) > 0 || len(tier.subnets) > 0 {
+				return nil, fmt.Errorf("the %s rate limit tier cannot list peers or subnets", name)
+			}
+			tiers.def = tier
+		} else {
+			tiers.tiers = append(tiers.tiers, tier)
+		}
+	}
+
+	return tiers, nil
+}
+
+func parseRateLimitTier(name string, cfg RateLimitTier) (*rateLimitTier, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid interval: %s", cfg.Interval)
+	}
+
+	tier := &rateLimitTier{
+		clock:    clock.New(),
+		name:     name,
+		peers:    make(map[peer.ID]struct{}, len(cfg.Peers)),
+		interval: cfg.Interval,
+		burst:    cfg.Burst,
+		buckets:  make(map[peer.ID]*tokenBucket),
+	}
+	if tier.burst < 1 {
+		tier.burst = 1
+	}
+
+	for _, s := range cfg.Peers {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing peer ID: %w", err)
+		}
+		tier.peers[p] = struct{}{}
+	}
+
+	for _, s := range cfg.Subnets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing subnet: %w", err)
+		}
+		tier.subnets = append(tier.subnets, ipnet)
+	}
+
+	return tier, nil
+}
+
+// tier returns the tier of the given peer requesting from the given address,
+// or nil if it is not rate limited.
+func (t *rateLimitTiers) tier(p peer.ID, addr ma.Multiaddr) *rateLimitTier {
+	if t == nil {
+		return nil
+	}
+
+	ip, _ := manet.ToIP(addr)
+	for _, tier := range t.tiers {
+		if tier.match(p, ip) {
+			return tier
+		}
+	}
+
+	return t.def
+}
+
+func (tier *rateLimitTier) match(p peer.ID, ip net.IP) bool {
+	if _, ok := tier.peers[p]; ok {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range tier.subnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allow takes a token from the bucket of the given peer, returning false if
+// the bucket is empty.
+func (tier *rateLimitTier) allow(p peer.ID) bool {
+	tier.mx.Lock()
+	defer tier.mx.Unlock()
+
+	now := tier.clock.Now()
+	tier.sweep(now)
+
+	b, ok := tier.buckets[p]
+	if !ok {
+		b = &tokenBucket{tokens: float64(tier.burst), updated: now}
+		tier.buckets[p] = b
+	} else {
+		tier.refill(b, now)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (tier *rateLimitTier) refill(b *tokenBucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.updated)) / float64(tier.interval)
+	if b.tokens > float64(tier.burst) {
+		b.tokens = float64(tier.burst)
+	}
+	b.updated = now
+}
+
+// sweep drops the buckets that have refilled, which are equivalent to new
+// ones.
+func (tier *rateLimitTier) sweep(now time.Time) {
+	if now.Sub(tier.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	tier.lastSweep = now
+
+	for p, b := range tier.buckets {
+		tier.refill(b, now)
+		if b.tokens >= float64(tier.burst) {
+			delete(tier.buckets, p)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestRateLimitTiers(t *testing.T) {
+	vip := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+
+	for _, tc := range []struct {
+		name    string
+		cfg     map[string]RateLimitTier
+		peer    peer.ID
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "no tiers", peer: other, addr: "/ip4/1.2.3.4/tcp/4001"},
+		{
+			name: "peer tier",
+			cfg: map[string]RateLimitTier{
+				"vip":                {Peers: []string{vip.String()}, Interval: time.Second},
+				DefaultRateLimitTier: {Interval: time.Minute},
+			},
+			peer: vip,
+			addr: "/ip4/1.2.3.4/tcp/4001",
+			want: "vip",
+		},
+		{
+			name: "subnet tier",
+			cfg: map[string]RateLimitTier{
+				"lan":                {Subnets: []string{"10.0.0.0/8"}, Interval: time.Second},
+				DefaultRateLimitTier: {Interval: time.Minute},
+			},
+			peer: other,
+			addr: "/ip4/10.1.2.3/tcp/4001",
+			want: "lan",
+		},
+		{
+			name: "tiers match in name order",
+			cfg: map[string]RateLimitTier{
+				"b": {Peers: []string{vip.String()}, Interval: time.Second},
+				"a": {Subnets: []string{"10.0.0.0/8"}, Interval: time.Second},
+			},
+			peer: vip,
+			addr: "/ip4/10.1.2.3/tcp/4001",
+			want: "a",
+		},
+		{
+			name: "default tier",
+			cfg: map[string]RateLimitTier{
+				"vip":                {Peers: []string{vip.String()}, Interval: time.Second},
+				DefaultRateLimitTier: {Interval: time.Minute},
+			},
+			peer: other,
+			addr: "/ip4/1.2.3.4/tcp/4001",
+			want: DefaultRateLimitTier,
+		},
+		{
+			name: "no default tier",
+			cfg:  map[string]RateLimitTier{"vip": {Peers: []string{vip.String()}, Interval: time.Second}},
+			peer: other,
+			addr: "/ip4/1.2.3.4/tcp/4001",
+		},
+		{
+			name:    "invalid interval",
+			cfg:     map[string]RateLimitTier{"vip": {Peers: []string{vip.String()}}},
+			wantErr: true,
+		},
+		{
+			name:    "default tier with peers",
+			cfg:     map[string]RateLimitTier{DefaultRateLimitTier: {Peers: []string{vip.String()}, Interval: time.Second}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid subnet",
+			cfg:     map[string]RateLimitTier{"lan": {Subnets: []string{"10.0.0.0"}, Interval: time.Second}},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tiers, err := parseRateLimitTiers(tc.cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got string
+			if tier := tiers.tier(tc.peer, ma.StringCast(tc.addr)); tier != nil {
+				got = tier.name
+			}
+			if got != tc.want {
+				t.Fatalf("got tier %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitTierBucket(t *testing.T) {
+	tier, err := parseRateLimitTier("test", RateLimitTier{Interval: time.Minute, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewMock()
+	tier.clock = clk
+
+	p, other := peer.ID("peer"), peer.ID("other")
+	for i, step := range []struct {
+		wait time.Duration
+		peer peer.ID
+		want bool
+	}{
+		// the burst is available at once
+		{peer: p, want: true},
+		{peer: p, want: true},
+		{peer: p, want: false},
+		// buckets are per peer
+		{peer: other, want: true},
+		// a token refills per interval
+		{wait: time.Minute / 2, peer: p, want: false},
+		{wait: time.Minute / 2, peer: p, want: true},
+		{peer: p, want: false},
+		// the bucket refills up to the burst
+		{wait: 10 * time.Minute, peer: p, want: true},
+		{peer: p, want: true},
+		{peer: p, want: false},
+	} {
+		clk.Add(step.wait)
+		if got := tier.allow(step.peer); got != step.want {
+			t.Fatalf("step %d: got %t, want %t", i, got, step.want)
+		}
+	}
+}
+
+func TestRateLimitTierSweep(t *testing.T) {
+	tier, err := parseRateLimitTier("test", RateLimitTier{Interval: time.Second, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewMock()
+	tier.clock = clk
+
+	tier.allow(peer.ID("idle"))
+	clk.Add(rateLimitSweepInterval)
+	tier.allow(peer.ID("active"))
+
+	// refilled buckets are dropped, but not the bucket just taken from
+	if _, ok := tier.buckets["idle"]; ok {
+		t.Fatal("refilled bucket not swept")
+	}
+	if _, ok := tier.buckets["active"]; !ok {
+		t.Fatal("current bucket swept")
+	}
+}
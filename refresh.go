@@ -0,0 +1,83 @@
+package relaydaemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// refreshSweepInterval is the minimum interval between sweeps of the refresh
+// counts of peers no longer holding a reservation.
+const refreshSweepInterval = time.Minute
+
+// RefreshLimiter wraps a relay ACL, declining the refreshes of a reservation
+// beyond a maximum count. The reservation then expires, and the peer has to
+// make a fresh reservation, which the wrapped ACL evaluates anew.
+type RefreshLimiter struct {
+	relayv2.ACLFilter
+
+	host host.Host
+	max  int
+
+	mx        sync.Mutex
+	refreshes map[peer.ID]int
+	lastSweep time.Time
+}
+
+// NewRefreshLimiter returns a refresh limiter wrapping the given ACL, allowing
+// at most max refreshes per reservation on the relay of the given host.
+func NewRefreshLimiter(acl relayv2.ACLFilter, h host.Host, max int) *RefreshLimiter {
+	return &RefreshLimiter{
+		ACLFilter: acl,
+		host:      h,
+		max:       max,
+		refreshes: make(map[peer.ID]int),
+	}
+}
+
+// AllowReserve defers to the wrapped ACL and counts the refreshes of the
+// reservation of the peer, denying them beyond the maximum.
+func (l *RefreshLimiter) AllowReserve(p peer.ID, addr ma.Multiaddr) (allow bool) {
+	defer recoverPanic("acl_reserve")
+
+	if !l.ACLFilter.AllowReserve(p, addr) {
+		return false
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.sweep()
+
+	if !hasReservation(l.host, p) {
+		delete(l.refreshes, p)
+		return true
+	}
+
+	if l.refreshes[p] >= l.max {
+		counterWith(reservationsRejected, "reservations_rejected", "refresh_limit").Inc()
+		return false
+	}
+	l.refreshes[p]++
+	return true
+}
+
+// sweep forgets the refresh counts of the peers no longer holding a
+// reservation, at most once per sweep interval.
+func (l *RefreshLimiter) sweep() {
+	now := time.Now()
+	if now.Sub(l.lastSweep) < refreshSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for p := range l.refreshes {
+		if !hasReservation(l.host, p) {
+			delete(l.refreshes, p)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package relaydaemon
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// testACL is a relay ACL allowing or denying everything.
+type testACL struct {
+	allow bool
+}
+
+func (a testACL) AllowReserve(peer.ID, ma.Multiaddr) bool          { return a.allow }
+func (a testACL) AllowConnect(peer.ID, ma.Multiaddr, peer.ID) bool { return a.allow }
+
+func TestRefreshLimiter(t *testing.T) {
+	p := peer.ID("peer")
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	for _, tc := range []struct {
+		name string
+		max  int
+		// whether the peer holds its reservation on each request
+		reserved []bool
+		want     []bool
+	}{
+		{
+			name:     "refreshes up to the maximum",
+			max:      2,
+			reserved: []bool{false, true, true, true},
+			want:     []bool{true, true, true, false},
+		},
+		{
+			name:     "fresh reservation resets the count",
+			max:      1,
+			reserved: []bool{false, true, true, false, true, true},
+			want:     []bool{true, true, false, true, true, false},
+		},
+		{
+			name:     "no refreshes",
+			max:      0,
+			reserved: []bool{false, true, false},
+			want:     []bool{true, false, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			l := NewRefreshLimiter(testACL{allow: true}, h, tc.max)
+
+			for i, reserved := range tc.reserved {
+				if reserved {
+					h.reserve(p)
+				} else {
+					h.cm.UntagPeer(p, ReservationTag)
+				}
+				if got := l.AllowReserve(p, addr); got != tc.want[i] {
+					t.Fatalf("request %d: got %t, want %t", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshLimiterDenied(t *testing.T) {
+	h := newTestHost()
+	p := peer.ID("peer")
+	h.reserve(p)
+
+	l := NewRefreshLimiter(testACL{allow: false}, h, 1)
+	if l.AllowReserve(p, ma.StringCast("/ip4/1.2.3.4/tcp/4001")) {
+		t.Fatal("reservation denied by the wrapped ACL allowed")
+	}
+	if l.refreshes[p] != 0 {
+		t.Fatal("denied refresh counted")
+	}
+}
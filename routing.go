@@ -0,0 +1,431 @@
+package relaydaemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// dhtModeInterval is the interval at which the effective DHT mode is sampled.
+const dhtModeInterval = 10 * time.Second
+
+// DHTModeOff is the DHT mode of the routing config which disables the DHT.
+const DHTModeOff = "off"
+
+// staticPeerMaxBackoff is the maximum delay between reconnection attempts to
+// a static peer.
+const staticPeerMaxBackoff = time.Minute
+
+// maxBackoff is the maximum delay between retries, unless the base interval
+// is longer.
+const maxBackoff = 10 * time.Minute
+
+// errEmptyRoutingTable is returned by DHT bootstrap attempts after which the
+// routing table is still empty.
+var errEmptyRoutingTable = errors.New("routing table is empty")
+
+// ParseDHTMode parses a DHT mode as given in the routing config; DHTModeOff
+// must be handled by the caller.
+func ParseDHTMode(s string) (dht.ModeOpt, error) {
+	switch s {
+	case "server":
+		return dht.ModeServer, nil
+	case "client":
+		return dht.ModeClient, nil
+	case "auto":
+		return dht.ModeAuto, nil
+	default:
+		return 0, fmt.Errorf("unknown DHT mode: %s", s)
+	}
+}
+
+// TrackDHTMode keeps the DHT mode gauge up to date with the effective mode of
+// the given DHT, until the context is done. In auto mode the DHT switches
+// between client and server depending on reachability.
+func TrackDHTMode(ctx context.Context, d *dht.IpfsDHT) {
+	ticker := time.NewTicker(dhtModeInterval)
+	defer ticker.Stop()
+
+	for {
+		setDHTMode(effectiveDHTMode(d))
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// effectiveDHTMode returns "server" if the DHT currently serves queries and
+// "client" otherwise.
+func effectiveDHTMode(d *dht.IpfsDHT) string {
+	for _, p := range d.Host().Mux().Protocols() {
+		if p == dht.ProtocolDHT {
+			return "server"
+		}
+	}
+
+	return "client"
+}
+
+// BootstrapWithRetry runs the given bootstrap function, retrying failures up
+// to maxRetries times with exponential backoff from the base interval and
+// jitter.
+func BootstrapWithRetry(ctx context.Context, bootstrap func(context.Context) error, maxRetries int, base time.Duration) error {
+	return bootstrapWithRetry(ctx, clock.New(), bootstrap, maxRetries, base)
+}
+
+// BootstrapDHT bootstraps the given DHT, retrying up to maxRetries times with
+// exponential backoff from the base interval while refreshing its routing
+// table fails or leaves it empty.
+func BootstrapDHT(ctx context.Context, d *dht.IpfsDHT, maxRetries int, base time.Duration) error {
+	return BootstrapWithRetry(ctx, func(ctx context.Context) error {
+		if err := d.Bootstrap(ctx); err != nil {
+			return err
+		}
+		return refreshRoutingTable(ctx, d.RefreshRoutingTable, d.RoutingTable().Size)
+	}, maxRetries, base)
+}
+
+// refreshRoutingTable waits for a routing table refresh started with the
+// given function, returning an error if it fails or if the routing table,
+// whose size is given by the size function, is still empty.
+func refreshRoutingTable(ctx context.Context, refresh func() <-chan error, size func() int) error {
+	select {
+	case err := <-refresh():
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if size() == 0 {
+		return errEmptyRoutingTable
+	}
+	return nil
+}
+
+func bootstrapWithRetry(ctx context.Context, clk clock.Clock, bootstrap func(context.Context) error, maxRetries int, base time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := bootstrap(ctx)
+		if err == nil || attempt >= maxRetries {
+			return err
+		}
+
+		delay := backoff(base, attempt)
+		fmt.Printf("error bootstrapping, retrying in %s: %s\n", delay, err)
+
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ParsePeers parses the given peer multiaddrs, such as bootstrap or static
+// peers, which must include the peer ID, grouping the addresses of each peer.
+func ParsePeers(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing peer address: %w", err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+
+	infos, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing peer address: %w", err)
+	}
+	return infos, nil
+}
+
+// ConnectBootstrapPeers connects the host to the given bootstrap peers, at
+// most concurrency at a time, retrying failed dials up to maxRetries times
+// with exponential backoff from the base interval. It returns the number of
+// peers connected once all dials are done or the context is done, so that the
+// context bounds the time a slow bootstrap peer can delay startup.
+func ConnectBootstrapPeers(ctx context.Context, h host.Host, peers []peer.AddrInfo, concurrency, maxRetries int, base time.Duration) int {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		connected atomic.Int32
+		sem       = make(chan struct{}, concurrency)
+	)
+	for _, pi := range peers {
+		pi := pi
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			fmt.Printf("Bootstrap peer %s: not dialed: %s\n", pi.ID, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// force direct dials, as retries would otherwise fail
+			// immediately on the swarm dial backoff
+			dctx := network.WithForceDirectDial(ctx, "bootstrap")
+			err := BootstrapWithRetry(dctx, func(ctx context.Context) error {
+				return h.Connect(ctx, pi)
+			}, maxRetries, base)
+			if err != nil {
+				fmt.Printf("Bootstrap peer %s: failed: %s\n", pi.ID, err)
+				return
+			}
+			Infof("Bootstrap peer %s: connected\n", pi.ID)
+			connected.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	return int(connected.Load())
+}
+
+// KeepStaticPeers connects the host to the given static peers and keeps them
+// connected until the context is done, reconnecting dropped peers with
+// exponential backoff from the base interval. The static peers are protected
+// from the connection manager.
+func KeepStaticPeers(ctx context.Context, h host.Host, peers []peer.AddrInfo, base time.Duration) {
+	dropped := make(map[peer.ID]chan struct{}, len(peers))
+	for _, pi := range peers {
+		dropped[pi.ID] = make(chan struct{}, 1)
+		h.ConnManager().Protect(pi.ID, "relayd-static")
+	}
+
+	notifiee := &network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			ch, ok := dropped[c.RemotePeer()]
+			if !ok || n.Connectedness(c.RemotePeer()) == network.Connected {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		},
+	}
+	h.Network().Notify(notifiee)
+	defer h.Network().StopNotify(notifiee)
+
+	var wg sync.WaitGroup
+	for _, pi := range peers {
+		pi := pi
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keepStaticPeer(ctx, h, pi, base, dropped[pi.ID])
+		}()
+	}
+	wg.Wait()
+}
+
+func keepStaticPeer(ctx context.Context, h host.Host, pi peer.AddrInfo, base time.Duration, dropped <-chan struct{}) {
+	// force direct dials, as reconnections would otherwise fail immediately
+	// on the swarm dial backoff
+	dctx := network.WithForceDirectDial(ctx, "static peer")
+
+	for attempt := 0; ; {
+		if h.Network().Connectedness(pi.ID) != network.Connected {
+			if err := h.Connect(dctx, pi); err != nil {
+				delay := backoff(base, attempt)
+				if delay > staticPeerMaxBackoff {
+					delay = staticPeerMaxBackoff
+				} else {
+					attempt++
+				}
+				fmt.Printf("Static peer %s: error connecting, retrying in %s: %s\n", pi.ID, delay, err)
+
+				select {
+				case <-time.After(delay):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			Infof("Static peer %s: connected\n", pi.ID)
+			attempt = 0
+		}
+
+		select {
+		case <-dropped:
+			Infof("Static peer %s: disconnected\n", pi.ID)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LimitedRouting bounds the number of concurrent lookups made through the
+// wrapped routing. Streaming lookups hold their slot until their results are
+// consumed or their context is done. Bootstrap is passed through: the DHT
+// bootstraps and refreshes its routing table in the background, with lookups
+// of its own that are not limited.
+type LimitedRouting struct {
+	routing.Routing
+	sem chan struct{}
+}
+
+var _ routing.Routing = (*LimitedRouting)(nil)
+
+// NewLimitedRouting returns a routing making at most max concurrent lookups
+// through the given routing.
+func NewLimitedRouting(r routing.Routing, max int) *LimitedRouting {
+	return &LimitedRouting{
+		Routing: r,
+		sem:     make(chan struct{}, max),
+	}
+}
+
+func (r *LimitedRouting) acquire(ctx context.Context) error {
+	select {
+	case r.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *LimitedRouting) release() {
+	<-r.sem
+}
+
+// FindPeer looks up the given peer once a lookup slot is available.
+func (r *LimitedRouting) FindPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
+	if err := r.acquire(ctx); err != nil {
+		return peer.AddrInfo{}, err
+	}
+	defer r.release()
+
+	return r.Routing.FindPeer(ctx, p)
+}
+
+// GetValue looks up the given key once a lookup slot is available.
+func (r *LimitedRouting) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	if err := r.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.Routing.GetValue(ctx, key, opts...)
+}
+
+// PutValue stores the given value once a lookup slot is available.
+func (r *LimitedRouting) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) error {
+	if err := r.acquire(ctx); err != nil {
+		return err
+	}
+	defer r.release()
+
+	return r.Routing.PutValue(ctx, key, value, opts...)
+}
+
+// Provide announces the given content once a lookup slot is available.
+func (r *LimitedRouting) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	if err := r.acquire(ctx); err != nil {
+		return err
+	}
+	defer r.release()
+
+	return r.Routing.Provide(ctx, c, announce)
+}
+
+// SearchValue searches for the given key once a lookup slot is available.
+func (r *LimitedRouting) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	if err := r.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	ch, err := r.Routing.SearchValue(ctx, key, opts...)
+	if err != nil {
+		r.release()
+		return nil, err
+	}
+	return forwardResults(ctx, r, ch), nil
+}
+
+// FindProvidersAsync looks up providers of the given content once a lookup
+// slot is available. The returned channel is closed right away if the
+// context is done first.
+func (r *LimitedRouting) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	if err := r.acquire(ctx); err != nil {
+		ch := make(chan peer.AddrInfo)
+		close(ch)
+		return ch
+	}
+
+	return forwardResults(ctx, r, r.Routing.FindProvidersAsync(ctx, c, count))
+}
+
+// forwardResults forwards the results of a streaming lookup, releasing its
+// lookup slot once they are consumed or the context is done.
+func forwardResults[T any](ctx context.Context, r *LimitedRouting, in <-chan T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer r.release()
+		defer close(out)
+
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// backoff returns the delay before the given retry attempt: the base interval
+// doubled on every attempt up to maxBackoff, with up to 50% jitter
+// subtracted.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	max := maxBackoff
+	if base > max {
+		max = base
+	}
+
+	d := max
+	if attempt < 63 && base <= max>>attempt {
+		d = base << attempt
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
@@ -0,0 +1,474 @@
+package relaydaemon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackoff(t *testing.T) {
+	base := time.Second
+	for attempt := 0; attempt < 8; attempt++ {
+		max := base << attempt
+		for i := 0; i < 100; i++ {
+			if d := backoff(base, attempt); d < max/2 || d > max {
+				t.Fatalf("attempt %d: delay %s not within [%s, %s]", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		base    time.Duration
+		attempt int
+		max     time.Duration
+	}{
+		{name: "capped", base: time.Second, attempt: 20, max: maxBackoff},
+		{name: "overflow", base: time.Second, attempt: 100, max: maxBackoff},
+		{name: "base above cap", base: time.Hour, attempt: 3, max: time.Hour},
+		{name: "zero base", base: 0, attempt: 100, max: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if d := backoff(tc.base, tc.attempt); d < tc.max/2 || d > tc.max {
+					t.Fatalf("delay %s not within [%s, %s]", d, tc.max/2, tc.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshRoutingTable(t *testing.T) {
+	refreshed := func(err error) func() <-chan error {
+		return func() <-chan error {
+			ch := make(chan error, 1)
+			ch <- err
+			return ch
+		}
+	}
+	size := func(n int) func() int {
+		return func() int { return n }
+	}
+	errRefresh := errors.New("refresh failed")
+
+	for _, tc := range []struct {
+		name    string
+		refresh func() <-chan error
+		size    int
+		want    error
+	}{
+		{name: "refreshed", refresh: refreshed(nil), size: 3},
+		{name: "refresh failed", refresh: refreshed(errRefresh), size: 3, want: errRefresh},
+		{name: "empty routing table", refresh: refreshed(nil), size: 0, want: errEmptyRoutingTable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := refreshRoutingTable(context.Background(), tc.refresh, size(tc.size)); !errors.Is(err, tc.want) {
+				t.Fatalf("error %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		pending := func() <-chan error { return make(chan error) }
+		if err := refreshRoutingTable(ctx, pending, size(3)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("error %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestBootstrapWithRetry(t *testing.T) {
+	errBootstrap := errors.New("bootstrap failed")
+
+	for _, tc := range []struct {
+		name       string
+		failures   int
+		maxRetries int
+		wantErr    error
+		wantCalls  int
+	}{
+		{name: "success", failures: 0, maxRetries: 3, wantCalls: 1},
+		{name: "success after retries", failures: 2, maxRetries: 3, wantCalls: 3},
+		{name: "retries exhausted", failures: 10, maxRetries: 3, wantErr: errBootstrap, wantCalls: 4},
+		{name: "no retries", failures: 10, maxRetries: 0, wantErr: errBootstrap, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const base = time.Second
+			clk := clock.NewMock()
+
+			var calls []time.Time
+			bootstrap := func(context.Context) error {
+				calls = append(calls, clk.Now())
+				if len(calls) <= tc.failures {
+					return errBootstrap
+				}
+				return nil
+			}
+
+			done := make(chan error)
+			go func() {
+				done <- bootstrapWithRetry(context.Background(), clk, bootstrap, tc.maxRetries, base)
+			}()
+
+			var err error
+		wait:
+			for {
+				select {
+				case err = <-done:
+					break wait
+				default:
+					clk.Add(base / 10)
+				}
+			}
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if len(calls) != tc.wantCalls {
+				t.Fatalf("got %d calls, want %d", len(calls), tc.wantCalls)
+			}
+			for i := 1; i < len(calls); i++ {
+				max := base << (i - 1)
+				// the clock advances in steps of a tenth of the base
+				if d := calls[i].Sub(calls[i-1]); d < max/2 || d > max+base/10 {
+					t.Errorf("retry %d after %s, want within [%s, %s]", i, d, max/2, max)
+				}
+			}
+		})
+	}
+}
+
+func TestBootstrapWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bootstrap := func(context.Context) error {
+		cancel()
+		return errors.New("bootstrap failed")
+	}
+
+	err := bootstrapWithRetry(ctx, clock.NewMock(), bootstrap, 3, time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// blockingRouting is a routing whose lookups block until released, counting
+// the lookups in progress.
+type blockingRouting struct {
+	routing.Routing
+
+	mx      sync.Mutex
+	active  int
+	max     int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRouting) FindPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
+	r.mx.Lock()
+	r.active++
+	if r.active > r.max {
+		r.max = r.active
+	}
+	r.mx.Unlock()
+
+	r.started <- struct{}{}
+	<-r.release
+
+	r.mx.Lock()
+	r.active--
+	r.mx.Unlock()
+	return peer.AddrInfo{ID: p}, nil
+}
+
+func TestLimitedRouting(t *testing.T) {
+	const limit, lookups = 2, 5
+
+	r := &blockingRouting{started: make(chan struct{}), release: make(chan struct{})}
+	lr := NewLimitedRouting(r, limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lr.FindPeer(context.Background(), peer.ID("peer"))
+		}()
+	}
+
+	// only as many lookups as the limit start until one is released
+	for i := 0; i < limit; i++ {
+		<-r.started
+	}
+	select {
+	case <-r.started:
+		t.Fatal("lookup started over the limit")
+	default:
+	}
+
+	for i := 0; i < lookups; i++ {
+		r.release <- struct{}{}
+		if i+limit < lookups {
+			<-r.started
+		}
+	}
+	wg.Wait()
+
+	if r.max != limit {
+		t.Fatalf("%d concurrent lookups, want %d", r.max, limit)
+	}
+}
+
+func TestLimitedRoutingCanceled(t *testing.T) {
+	r := &blockingRouting{started: make(chan struct{}, 1), release: make(chan struct{})}
+	lr := NewLimitedRouting(r, 1)
+
+	go lr.FindPeer(context.Background(), peer.ID("peer"))
+	<-r.started
+	defer close(r.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lr.FindPeer(ctx, peer.ID("peer")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// streamingRouting is a routing whose streaming lookups return the given
+// channels.
+type streamingRouting struct {
+	routing.Routing
+
+	values    chan []byte
+	providers chan peer.AddrInfo
+}
+
+func (r *streamingRouting) SearchValue(context.Context, string, ...routing.Option) (<-chan []byte, error) {
+	return r.values, nil
+}
+
+func (r *streamingRouting) FindProvidersAsync(context.Context, cid.Cid, int) <-chan peer.AddrInfo {
+	return r.providers
+}
+
+func TestLimitedRoutingStreaming(t *testing.T) {
+	r := &streamingRouting{values: make(chan []byte), providers: make(chan peer.AddrInfo)}
+	lr := NewLimitedRouting(r, 1)
+
+	released := func(t *testing.T) {
+		t.Helper()
+
+		for start := time.Now(); len(lr.sem) > 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("lookup slot not released")
+			}
+		}
+	}
+	limited := func(t *testing.T) {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := lr.SearchValue(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		if _, ok := <-lr.FindProvidersAsync(ctx, cid.Cid{}, 1); ok {
+			t.Fatal("providers found over the limit")
+		}
+	}
+
+	t.Run("search value", func(t *testing.T) {
+		values, err := lr.SearchValue(context.Background(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		limited(t)
+
+		r.values <- []byte("value")
+		if v := <-values; string(v) != "value" {
+			t.Fatalf("got value %q", v)
+		}
+		limited(t)
+
+		r.values <- nil
+		close(r.values)
+		<-values
+		if _, ok := <-values; ok {
+			t.Fatal("values not closed")
+		}
+		released(t)
+	})
+
+	t.Run("find providers canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		providers := lr.FindProvidersAsync(ctx, cid.Cid{}, 1)
+		limited(t)
+
+		// the slot is released once the lookup is canceled, even if the
+		// wrapped routing does not close its results
+		cancel()
+		if _, ok := <-providers; ok {
+			t.Fatal("providers not closed")
+		}
+		released(t)
+	})
+}
+
+func TestDHTMode(t *testing.T) {
+	for _, mode := range []string{"server", "client"} {
+		t.Run(mode, func(t *testing.T) {
+			h, err := libp2p.New(libp2p.NoListenAddrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			opt, err := ParseDHTMode(mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := dht.New(context.Background(), h, dht.Mode(opt), dht.DisableAutoRefresh())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			setDHTMode(effectiveDHTMode(d))
+			for _, m := range []string{"server", "client"} {
+				want := 0.0
+				if m == mode {
+					want = 1
+				}
+				if got := testutil.ToFloat64(gaugeWith(dhtMode, "dht_mode", m)); got != want {
+					t.Fatalf("dht mode %s: got %g, want %g", m, got, want)
+				}
+			}
+		})
+	}
+}
+
+// connectHost is a host whose connections are made by a function.
+type connectHost struct {
+	host.Host
+
+	connect func(ctx context.Context, pi peer.AddrInfo) error
+}
+
+func (h *connectHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	return h.connect(ctx, pi)
+}
+
+func TestConnectBootstrapPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var (
+		mx      sync.Mutex
+		active  int
+		maxSeen int
+		flaked  bool
+	)
+	h := &connectHost{connect: func(ctx context.Context, pi peer.AddrInfo) error {
+		mx.Lock()
+		active++
+		if active > maxSeen {
+			maxSeen = active
+		}
+		mx.Unlock()
+		defer func() {
+			mx.Lock()
+			active--
+			mx.Unlock()
+		}()
+
+		switch pi.ID {
+		case "slow":
+			<-ctx.Done()
+			return ctx.Err()
+		case "failing":
+			return errors.New("connection refused")
+		case "flaky":
+			mx.Lock()
+			defer mx.Unlock()
+			if !flaked {
+				flaked = true
+				return errors.New("connection reset")
+			}
+		}
+		return nil
+	}}
+
+	var peers []peer.AddrInfo
+	for _, id := range []peer.ID{"slow", "fast", "failing", "flaky", "faster"} {
+		peers = append(peers, peer.AddrInfo{ID: id})
+	}
+
+	start := time.Now()
+	n := ConnectBootstrapPeers(ctx, h, peers, 2, 3, time.Millisecond)
+	if n != 3 {
+		t.Fatalf("%d bootstrap peers connected, want 3", n)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("bootstrap took %s despite the deadline", elapsed)
+	}
+	if maxSeen > 2 {
+		t.Fatalf("%d concurrent dials, want at most 2", maxSeen)
+	}
+}
+
+func TestKeepStaticPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h := newLoopbackHost(t)
+	static := newLoopbackHost(t)
+	go KeepStaticPeers(ctx, h, []peer.AddrInfo{{ID: static.ID(), Addrs: static.Addrs()}}, 10*time.Millisecond)
+
+	connected := func(t *testing.T) {
+		t.Helper()
+
+		for h.Network().Connectedness(static.ID()) != network.Connected {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatal("static peer not connected")
+			}
+		}
+	}
+
+	connected(t)
+	if !h.ConnManager().IsProtected(static.ID(), "relayd-static") {
+		t.Fatal("static peer not protected")
+	}
+
+	// the connection drops, and is then reconnected
+	dropped := h.Network().ConnsToPeer(static.ID())[0]
+	if err := dropped.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		conns := h.Network().ConnsToPeer(static.ID())
+		if len(conns) > 0 && conns[0] != dropped {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("static peer not reconnected")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package relaydaemon
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// reserveChurnWindow is the interval within which a repeated reservation
+	// request from the same peer counts as churn; clients normally renew
+	// their reservations shortly before they expire.
+	reserveChurnWindow = time.Minute
+	// scoreSweepInterval is the minimum interval between sweeps of peers whose
+	// score has decayed to zero.
+	scoreSweepInterval = time.Minute
+)
+
+// peerScores keeps a decaying score per peer, which starts at zero and drops
+// on misbehavior: reservation requests in rapid succession, reservation
+// requests denied by the ACL, and circuit requests that fail because the
+// destination holds no reservation or is denied by the ACL. Protocol
+// violations are not scored, as the relay does not report the offending peer.
+type peerScores struct {
+	clock    clock.Clock
+	halfLife time.Duration
+
+	mx        sync.Mutex
+	scores    map[peer.ID]*peerScore
+	lastSweep time.Time
+}
+
+type peerScore struct {
+	value       float64
+	updated     time.Time
+	lastReserve time.Time
+}
+
+func newPeerScores(halfLife time.Duration) *peerScores {
+	return &peerScores{
+		clock:    clock.New(),
+		halfLife: halfLife,
+		scores:   make(map[peer.ID]*peerScore),
+	}
+}
+
+// reserve records a reservation request from the given peer, penalizing it if
+// it follows the previous one within the churn window, and returns the score
+// of the peer.
+func (s *peerScores) reserve(p peer.ID) float64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := s.clock.Now()
+	ps := s.get(p, now)
+	if now.Sub(ps.lastReserve) < reserveChurnWindow {
+		ps.value--
+	}
+	ps.lastReserve = now
+
+	s.sweep(now)
+	return ps.value
+}
+
+// penalize drops the score of the given peer.
+func (s *peerScores) penalize(p peer.ID) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.get(p, s.clock.Now()).value--
+}
+
+// get returns the score of the given peer, decayed to now.
+func (s *peerScores) get(p peer.ID, now time.Time) *peerScore {
+	ps, ok := s.scores[p]
+	if !ok {
+		ps = &peerScore{updated: now}
+		s.scores[p] = ps
+		return ps
+	}
+
+	if s.halfLife > 0 {
+		ps.value *= math.Pow(0.5, float64(now.Sub(ps.updated))/float64(s.halfLife))
+	}
+	ps.updated = now
+	return ps
+}
+
+// sweep forgets the peers whose score has decayed to zero, at most once per
+// sweep interval.
+func (s *peerScores) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < scoreSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for p, ps := range s.scores {
+		if now.Sub(ps.lastReserve) < reserveChurnWindow {
+			continue
+		}
+		if s.get(p, now).value > -0.01 {
+			delete(s.scores, p)
+		}
+	}
+}
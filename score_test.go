@@ -0,0 +1,121 @@
+package relaydaemon
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func newTestScores(halfLife time.Duration) (*peerScores, *clock.Mock) {
+	clk := clock.NewMock()
+	s := newPeerScores(halfLife)
+	s.clock = clk
+	return s, clk
+}
+
+func TestPeerScores(t *testing.T) {
+	const halfLife = 10 * time.Minute
+	p := peer.ID("peer")
+
+	for _, tc := range []struct {
+		name string
+		// intervals between reservation requests
+		intervals []time.Duration
+		penalties int
+		want      float64
+	}{
+		{name: "first request", intervals: []time.Duration{0}, want: 0},
+		{name: "renewals", intervals: []time.Duration{0, 50 * time.Minute, 50 * time.Minute}, want: 0},
+		{name: "churn", intervals: []time.Duration{0, time.Second, time.Second, time.Second}, want: -3},
+		{name: "penalties", intervals: []time.Duration{0}, penalties: 2, want: -2},
+		{name: "decay", intervals: []time.Duration{0, time.Second, time.Second, halfLife}, want: -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, clk := newTestScores(halfLife)
+			for i := 0; i < tc.penalties; i++ {
+				s.penalize(p)
+			}
+
+			var score float64
+			for _, d := range tc.intervals {
+				clk.Add(d)
+				score = s.reserve(p)
+			}
+			if math.Abs(score-tc.want) > 0.01 {
+				t.Fatalf("score %f, want %f", score, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeerScoresRecover(t *testing.T) {
+	const halfLife = time.Minute
+	s, clk := newTestScores(halfLife)
+	p := peer.ID("peer")
+
+	for i := 0; i < 8; i++ {
+		s.penalize(p)
+	}
+	if got := s.get(p, clk.Now()).value; got != -8 {
+		t.Fatalf("score %f, want -8", got)
+	}
+
+	clk.Add(3 * halfLife)
+	if got := s.get(p, clk.Now()).value; math.Abs(got+1) > 0.01 {
+		t.Fatalf("score after 3 half-lives %f, want -1", got)
+	}
+
+	// once decayed to zero, the peer is forgotten
+	clk.Add(20 * halfLife)
+	s.reserve(peer.ID("other"))
+	if _, ok := s.scores[p]; ok {
+		t.Fatal("decayed peer not forgotten")
+	}
+}
+
+func TestACLConnectPenalties(t *testing.T) {
+	h := newTestHost()
+	reserved := test.RandPeerIDFatal(t)
+	unreserved := test.RandPeerIDFatal(t)
+	denied := test.RandPeerIDFatal(t)
+	deniedUnreserved := test.RandPeerIDFatal(t)
+	h.reserve(reserved)
+	h.reserve(denied)
+
+	for _, tc := range []struct {
+		name  string
+		mode  string
+		dest  peer.ID
+		allow bool
+		want  float64
+	}{
+		{name: "reserved", mode: "enforce", dest: reserved, allow: true, want: 0},
+		{name: "unreserved", mode: "enforce", dest: unreserved, allow: true, want: -1},
+		{name: "denied", mode: "enforce", dest: denied, allow: false, want: -1},
+		// penalized once, although denied and holding no reservation
+		{name: "denied and unreserved", mode: "enforce", dest: deniedUnreserved, allow: false, want: -1},
+		{name: "observed unreserved", mode: "observe", dest: unreserved, allow: true, want: 0},
+		{name: "observed denied", mode: "observe", dest: deniedUnreserved, allow: true, want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			acl, err := NewACL(h, ACLConfig{Mode: tc.mode, AllowPeers: []string{reserved.String(), unreserved.String()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src := peer.ID("src")
+			var allow bool
+			captureOutput(t, func() { allow = acl.AllowConnect(src, nil, tc.dest) })
+			if allow != tc.allow {
+				t.Fatalf("got %t, want %t", allow, tc.allow)
+			}
+			if got := acl.scores.get(src, acl.scores.clock.Now()).value; math.Abs(got-tc.want) > 0.01 {
+				t.Fatalf("score %f, want %f", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package relaydaemon
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+const (
+	// maxUptimeJitter is the maximum fraction of the maximum uptime by which
+	// the scheduled shutdown is randomly delayed, so that a fleet started at
+	// once does not restart at once.
+	maxUptimeJitter = 0.1
+	// maxUptimeDrainPeriod is how long the daemon drains before a scheduled
+	// shutdown.
+	maxUptimeDrainPeriod = time.Minute
+)
+
+// Shutdown signals a graceful shutdown of the daemon, which can be requested
+// from several places (signals, the admin API) but happens once.
+type Shutdown struct {
+	clock clock.Clock
+	once  sync.Once
+	done  chan struct{}
+}
+
+// NewShutdown returns a new, not yet requested, shutdown signal.
+func NewShutdown() *Shutdown {
+	return &Shutdown{clock: clock.New(), done: make(chan struct{})}
+}
+
+// Request requests a graceful shutdown; subsequent requests are no-ops.
+func (s *Shutdown) Request() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Done returns a channel that is closed once a shutdown has been requested.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.done
+}
+
+// RequestAfterUptime schedules a graceful shutdown once the daemon has been
+// up for the given maximum uptime, plus a random jitter of up to a tenth of
+// it. The ACL drains for a minute before the shutdown is requested.
+func (s *Shutdown) RequestAfterUptime(maxUptime time.Duration, acl *ACLFilter) {
+	jitter := time.Duration(rand.Int63n(int64(float64(maxUptime)*maxUptimeJitter) + 1))
+	s.clock.AfterFunc(maxUptime+jitter, func() {
+		fmt.Printf("Maximum uptime reached, draining before shutting down\n")
+		acl.SetDraining(true)
+		s.clock.AfterFunc(maxUptimeDrainPeriod, s.Request)
+	})
+}
@@ -0,0 +1,51 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestShutdownRequestAfterUptime(t *testing.T) {
+	const maxUptime = time.Hour
+
+	clk := clock.NewMock()
+	s := NewShutdown()
+	s.clock = clk
+	acl := &ACLFilter{}
+
+	s.RequestAfterUptime(maxUptime, acl)
+	start := clk.Now()
+
+	done := func() bool {
+		select {
+		case <-s.Done():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// draining starts after the maximum uptime and its jitter
+	clk.Add(maxUptime - time.Second)
+	for !acl.draining.Load() {
+		if done() {
+			t.Fatal("shut down before draining")
+		}
+		clk.Add(time.Second)
+	}
+	if uptime := clk.Now().Sub(start); uptime < maxUptime || uptime > maxUptime+time.Duration(float64(maxUptime)*maxUptimeJitter)+time.Second {
+		t.Fatalf("draining after %s", uptime)
+	}
+
+	// the shutdown is requested after the drain period
+	clk.Add(maxUptimeDrainPeriod - time.Second)
+	if done() {
+		t.Fatal("shut down before the end of the drain period")
+	}
+	clk.Add(time.Second)
+	if !done() {
+		t.Fatal("not shut down after the drain period")
+	}
+}
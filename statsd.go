@@ -0,0 +1,47 @@
+package relaydaemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// PushStatsD periodically pushes the core relay daemon metrics as StatsD
+// gauges and counters to the given UDP address, until the context is done.
+func PushStatsD(ctx context.Context, addr string, interval time.Duration, h host.Host, tracer *MetricsTracer) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastBytes := tracer.TotalBytes()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		totalBytes := tracer.TotalBytes()
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s.reservations:%d|g\n", metricNamespace, tracer.Reservations())
+		fmt.Fprintf(&buf, "%s.circuits:%d|g\n", metricNamespace, tracer.Circuits())
+		fmt.Fprintf(&buf, "%s.connections:%d|g\n", metricNamespace, len(h.Network().Conns()))
+		fmt.Fprintf(&buf, "%s.peers:%d|g\n", metricNamespace, len(h.Network().Peers()))
+		fmt.Fprintf(&buf, "%s.bytes_relayed:%d|c", metricNamespace, totalBytes-lastBytes)
+		lastBytes = totalBytes
+
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			fmt.Printf("error pushing StatsD metrics: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package relaydaemon
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+func TestPushStatsD(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	h := newTestHost()
+	h.net.conns = make(map[peer.ID][]network.Conn)
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+
+	// two connections to a reserved peer and a connection to another peer
+	reserved, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{reserved, reserved, other} {
+		c := newTestConn("1.2.3.4", 4001, network.DirInbound)
+		c.peer = p
+		h.net.conns[p] = append(h.net.conns[p], c)
+		h.net.connected[p] = true
+	}
+	h.reserve(reserved)
+	tracer.ReservationAllowed(false)
+	tracer.ConnectionOpened()
+	// relayed before the daemon started pushing
+	tracer.BytesTransferred(100)
+
+	const interval = 20 * time.Millisecond
+	start := time.Now()
+	done := make(chan error)
+	go func() { done <- PushStatsD(ctx, l.LocalAddr().String(), interval, h, tracer) }()
+
+	read := func() []string {
+		t.Helper()
+
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 1024)
+		n, _, err := l.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(b[:n]), "\n")
+	}
+
+	lines := read()
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("metrics pushed after %s, before the interval of %s", elapsed, interval)
+	}
+	want := []string{
+		"relayd.reservations:1|g",
+		"relayd.circuits:1|g",
+		"relayd.connections:3|g",
+		"relayd.peers:2|g",
+		"relayd.bytes_relayed:0|c",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("pushed %q, want %q", lines, want)
+	}
+
+	// the bytes relayed are counted once, in the next push
+	tracer.BytesTransferred(50)
+	var relayed []string
+	for len(relayed) < 2 {
+		lines := read()
+		last := lines[len(lines)-1]
+		if len(relayed) == 0 && last == "relayd.bytes_relayed:0|c" {
+			continue
+		}
+		relayed = append(relayed, last)
+	}
+	if relayed[0] != "relayd.bytes_relayed:50|c" || relayed[1] != "relayd.bytes_relayed:0|c" {
+		t.Fatalf("bytes relayed pushed as %q", relayed)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushing did not stop")
+	}
+}
@@ -0,0 +1,124 @@
+package relaydaemon
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// StickyReservations wraps a relay ACL, holding the reservation slot of a
+// peer that disconnects for a grace window, so that it can reserve again if
+// it reconnects from the same IP. While slots are scarce, new peers are
+// denied the slots held for reconnecting peers.
+type StickyReservations struct {
+	relayv2.ACLFilter
+
+	clock           clock.Clock
+	tracer          *MetricsTracer
+	maxReservations int
+	window          time.Duration
+
+	mx sync.Mutex
+	// IPs of the peers allowed to reserve, while connected
+	held map[peer.ID]net.IP
+	// slots held for disconnected peers
+	sticky map[peer.ID]stickySlot
+}
+
+type stickySlot struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// NewStickyReservations returns a sticky reservations ACL wrapping the given
+// ACL, for a relay on the given host with the given maximum number of
+// reservations, whose reservations are tracked by the given metrics tracer.
+func NewStickyReservations(acl relayv2.ACLFilter, h host.Host, tracer *MetricsTracer, maxReservations int, window time.Duration) *StickyReservations {
+	s := &StickyReservations{
+		ACLFilter:       acl,
+		clock:           clock.New(),
+		tracer:          tracer,
+		maxReservations: maxReservations,
+		window:          window,
+		held:            make(map[peer.ID]net.IP),
+		sticky:          make(map[peer.ID]stickySlot),
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: s.disconnected,
+	})
+
+	return s
+}
+
+// AllowReserve defers to the wrapped ACL, then lets peers reconnecting from
+// the same IP within the grace window reclaim their slot, and denies new
+// peers if the free slots are held for reconnecting peers.
+func (s *StickyReservations) AllowReserve(p peer.ID, addr ma.Multiaddr) (allow bool) {
+	defer recoverPanic("acl_reserve")
+
+	if !s.ACLFilter.AllowReserve(p, addr) {
+		return false
+	}
+
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return true
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := s.clock.Now()
+	for sp, slot := range s.sticky {
+		if now.After(slot.expires) {
+			delete(s.sticky, sp)
+		}
+	}
+
+	if _, ok := s.held[p]; ok {
+		s.held[p] = ip
+		return true
+	}
+
+	if slot, ok := s.sticky[p]; ok && slot.ip.Equal(ip) {
+		delete(s.sticky, p)
+		s.held[p] = ip
+		return true
+	}
+
+	if s.tracer.Reservations()+len(s.sticky) >= s.maxReservations {
+		counterWith(reservationsRejected, "reservations_rejected", "sticky").Inc()
+		return false
+	}
+
+	s.held[p] = ip
+	return true
+}
+
+// disconnected holds the slot of a peer that was allowed to reserve once it
+// is fully disconnected.
+func (s *StickyReservations) disconnected(n network.Network, c network.Conn) {
+	p := c.RemotePeer()
+	if n.Connectedness(p) == network.Connected {
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	ip, ok := s.held[p]
+	if !ok {
+		return
+	}
+	delete(s.held, p)
+	s.sticky[p] = stickySlot{ip: ip, expires: s.clock.Now().Add(s.window)}
+}
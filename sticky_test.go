@@ -0,0 +1,101 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestStickyReservations(t *testing.T) {
+	const window = time.Minute
+
+	type step struct {
+		// reserve from the IP, or disconnect if empty, or wait
+		peer string
+		ip   string
+		wait time.Duration
+		want bool
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "reconnecting peer reclaims its slot",
+			steps: []step{
+				{peer: "a", ip: "1.1.1.1", want: true},
+				{peer: "b", ip: "2.2.2.2", want: true},
+				{peer: "a"},
+				{peer: "c", ip: "3.3.3.3", want: false},
+				{peer: "a", ip: "1.1.1.1", want: true},
+			},
+		},
+		{
+			name: "reconnecting from another IP is a new peer",
+			steps: []step{
+				{peer: "a", ip: "1.1.1.1", want: true},
+				{peer: "b", ip: "2.2.2.2", want: true},
+				{peer: "a"},
+				{peer: "a", ip: "4.4.4.4", want: false},
+			},
+		},
+		{
+			name: "slot released after the window",
+			steps: []step{
+				{peer: "a", ip: "1.1.1.1", want: true},
+				{peer: "b", ip: "2.2.2.2", want: true},
+				{peer: "a"},
+				{wait: window + time.Second},
+				{peer: "c", ip: "3.3.3.3", want: true},
+				{peer: "a", ip: "1.1.1.1", want: false},
+			},
+		},
+		{
+			name: "renewals are allowed",
+			steps: []step{
+				{peer: "a", ip: "1.1.1.1", want: true},
+				{peer: "b", ip: "2.2.2.2", want: true},
+				{peer: "a", ip: "1.1.1.1", want: true},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHost()
+			clk := clock.NewMock()
+			tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 2})
+			s := NewStickyReservations(testACL{allow: true}, h, tracer, 2, window)
+			s.clock = clk
+
+			for i, st := range tc.steps {
+				p := peer.ID(st.peer)
+				switch {
+				case st.wait > 0:
+					clk.Add(st.wait)
+				case st.ip == "":
+					// the reservation goes with the connection
+					h.net.connected[p] = false
+					h.cm.UntagPeer(p, ReservationTag)
+					tracer.ReservationClosed(1)
+					c := newTestConn("1.1.1.1", 4001, network.DirInbound)
+					c.peer = p
+					s.disconnected(h.net, c)
+				default:
+					addr := ma.StringCast("/ip4/" + st.ip + "/tcp/4001")
+					got := s.AllowReserve(p, addr)
+					if got != st.want {
+						t.Fatalf("step %d: reservation for %s from %s: got %t, want %t", i, st.peer, st.ip, got, st.want)
+					}
+					if got && !hasReservation(h, p) {
+						h.reserve(p)
+						tracer.ReservationAllowed(false)
+					}
+				}
+			}
+		})
+	}
+}
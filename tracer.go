@@ -0,0 +1,227 @@
+package relaydaemon
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// MetricsTracer wraps the relay metrics tracer, additionally keeping track of
+// the relay activity for the relay daemon metrics.
+type MetricsTracer struct {
+	relayv2.MetricsTracer
+
+	clock           clock.Clock
+	host            host.Host
+	maxReservations int
+
+	circuits atomic.Int64
+	bytes    atomic.Uint64
+
+	mx           sync.Mutex
+	reservations int
+	// time at which each reserved peer was first seen holding its reservation
+	granted map[peer.ID]time.Time
+	// functions called when a circuit is established
+	circuitObservers []func()
+}
+
+var _ relayv2.MetricsTracer = (*MetricsTracer)(nil)
+
+// NewMetricsTracer returns a metrics tracer wrapping the given relay metrics
+// tracer, for a relay on the given host using the given resources.
+func NewMetricsTracer(tracer relayv2.MetricsTracer, h host.Host, resources relayv2.Resources) *MetricsTracer {
+	return &MetricsTracer{
+		MetricsTracer:   tracer,
+		clock:           clock.New(),
+		host:            h,
+		maxReservations: resources.MaxReservations,
+		granted:         make(map[peer.ID]time.Time),
+	}
+}
+
+// ReservationAllowed tracks a new or renewed reservation.
+func (t *MetricsTracer) ReservationAllowed(isRenewal bool) {
+	t.MetricsTracer.ReservationAllowed(isRenewal)
+	if isRenewal {
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.reservations++
+	t.updateReservations()
+}
+
+// ReservationClosed tracks expired or dropped reservations. The relay calls
+// it on each garbage collection, even if no reservation expired, which keeps
+// the age of the oldest reservation current.
+func (t *MetricsTracer) ReservationClosed(cnt int) {
+	t.MetricsTracer.ReservationClosed(cnt)
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if cnt == 0 {
+		t.updateOldestReservation(t.clock.Now())
+		return
+	}
+
+	t.reservations -= cnt
+	if t.reservations < 0 {
+		t.reservations = 0
+	}
+	t.updateReservations()
+}
+
+// ReservationRequestHandled tracks reservation requests rejected as
+// malformed.
+func (t *MetricsTracer) ReservationRequestHandled(status pbv2.Status) {
+	t.MetricsTracer.ReservationRequestHandled(status)
+	if status == pbv2.Status_MALFORMED_MESSAGE {
+		counterWith(malformedStreams, "malformed_streams", "reserve").Inc()
+	}
+}
+
+// ConnectionRequestHandled tracks connection requests rejected as malformed,
+// such as requests without a valid destination, and notifies the circuit
+// observers of established circuits.
+func (t *MetricsTracer) ConnectionRequestHandled(status pbv2.Status) {
+	t.MetricsTracer.ConnectionRequestHandled(status)
+
+	switch status {
+	case pbv2.Status_MALFORMED_MESSAGE:
+		counterWith(malformedStreams, "malformed_streams", "connect").Inc()
+	case pbv2.Status_OK:
+		t.mx.Lock()
+		observers := t.circuitObservers
+		t.mx.Unlock()
+
+		for _, f := range observers {
+			f()
+		}
+	}
+}
+
+// observeCircuits registers a function called whenever a circuit is
+// established. The relay does not report the peers of the circuit.
+func (t *MetricsTracer) observeCircuits(f func()) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.circuitObservers = append(t.circuitObservers, f)
+}
+
+// ConnectionOpened tracks a new relayed connection.
+func (t *MetricsTracer) ConnectionOpened() {
+	t.MetricsTracer.ConnectionOpened()
+	t.circuits.Add(1)
+}
+
+// ConnectionClosed tracks a closed relayed connection.
+func (t *MetricsTracer) ConnectionClosed(d time.Duration) {
+	t.MetricsTracer.ConnectionClosed(d)
+	t.circuits.Add(-1)
+}
+
+// BytesTransferred tracks the bytes relayed.
+func (t *MetricsTracer) BytesTransferred(cnt int) {
+	t.MetricsTracer.BytesTransferred(cnt)
+	t.bytes.Add(uint64(cnt))
+}
+
+// Circuits returns the number of active relayed connections.
+func (t *MetricsTracer) Circuits() int {
+	return int(t.circuits.Load())
+}
+
+// TotalBytes returns the total number of bytes relayed.
+func (t *MetricsTracer) TotalBytes() uint64 {
+	return t.bytes.Load()
+}
+
+// Reservations returns the number of active reservations.
+func (t *MetricsTracer) Reservations() int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return t.reservations
+}
+
+// Granted returns the time at which the given peer was first seen holding its
+// current reservation, or the zero time if unknown.
+func (t *MetricsTracer) Granted(p peer.ID) time.Time {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return t.granted[p]
+}
+
+func (t *MetricsTracer) updateReservations() {
+	if t.maxReservations > 0 {
+		reservationUtilization.Set(float64(t.reservations) / float64(t.maxReservations))
+	}
+
+	peers := ReservedPeers(t.host)
+	reservingSubnets.Set(float64(countSubnets(t.host, peers)))
+
+	now := t.clock.Now()
+	reserved := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		reserved[p] = struct{}{}
+		if _, ok := t.granted[p]; !ok {
+			t.granted[p] = now
+		}
+	}
+	for p := range t.granted {
+		if _, ok := reserved[p]; !ok {
+			delete(t.granted, p)
+		}
+	}
+	t.updateOldestReservation(now)
+}
+
+func (t *MetricsTracer) updateOldestReservation(now time.Time) {
+	var age time.Duration
+	for _, granted := range t.granted {
+		if now.Sub(granted) > age {
+			age = now.Sub(granted)
+		}
+	}
+	oldestReservationAge.Set(age.Seconds())
+}
+
+// countSubnets returns the number of distinct subnets, /24 for IPv4 and /64
+// for IPv6, that the given peers are connected from.
+func countSubnets(h host.Host, peers []peer.ID) int {
+	subnets := make(map[string]struct{})
+	for _, p := range peers {
+		for _, c := range h.Network().ConnsToPeer(p) {
+			ip, err := manet.ToIP(c.RemoteMultiaddr())
+			if err != nil {
+				continue
+			}
+			subnets[subnetKey(ip)] = struct{}{}
+		}
+	}
+
+	return len(subnets)
+}
+
+// subnetKey returns the /24 network of IPv4 addresses and the /64 network of
+// IPv6 addresses.
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,193 @@
+package relaydaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testHost is a host of which only the network and connection manager are
+// known.
+type testHost struct {
+	host.Host
+
+	net *testNetwork
+	cm  *TagConnMgr
+}
+
+func newTestHost() *testHost {
+	return &testHost{
+		net: &testNetwork{connected: make(map[peer.ID]bool)},
+		cm:  NewTagConnMgr(),
+	}
+}
+
+func (h *testHost) Network() network.Network         { return h.net }
+func (h *testHost) ConnManager() connmgr.ConnManager { return h.cm }
+func (h *testHost) Peerstore() peerstore.Peerstore   { return h.net.ps }
+
+// reserve connects the given peer and tags it as holding a reservation.
+func (h *testHost) reserve(p peer.ID) {
+	h.net.connected[p] = true
+	h.cm.TagPeer(p, ReservationTag, 1)
+}
+
+// nopRelayTracer is a relay metrics tracer that discards everything.
+type nopRelayTracer struct{}
+
+var _ relayv2.MetricsTracer = nopRelayTracer{}
+
+func (nopRelayTracer) RelayStatus(bool)                      {}
+func (nopRelayTracer) ConnectionOpened()                     {}
+func (nopRelayTracer) ConnectionClosed(time.Duration)        {}
+func (nopRelayTracer) ConnectionRequestHandled(pbv2.Status)  {}
+func (nopRelayTracer) ReservationAllowed(bool)               {}
+func (nopRelayTracer) ReservationClosed(int)                 {}
+func (nopRelayTracer) ReservationRequestHandled(pbv2.Status) {}
+func (nopRelayTracer) BytesTransferred(int)                  {}
+
+func TestMetricsTracerOldestReservation(t *testing.T) {
+	h := newTestHost()
+	clk := clock.NewMock()
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+	tracer.clock = clk
+
+	first, second := peer.ID("first"), peer.ID("second")
+
+	h.reserve(first)
+	tracer.ReservationAllowed(false)
+	clk.Add(time.Minute)
+
+	h.reserve(second)
+	tracer.ReservationAllowed(false)
+	if got := testutil.ToFloat64(oldestReservationAge); got != 60 {
+		t.Fatalf("oldest reservation age %f, want 60", got)
+	}
+	if got := testutil.ToFloat64(reservationUtilization); got != 0.5 {
+		t.Fatalf("reservation utilization %f, want 0.5", got)
+	}
+
+	// garbage collections without expiry keep the age current
+	clk.Add(time.Minute)
+	tracer.ReservationClosed(0)
+	if got := testutil.ToFloat64(oldestReservationAge); got != 120 {
+		t.Fatalf("oldest reservation age %f, want 120", got)
+	}
+
+	// once the oldest reservation expires, the next one is the oldest
+	h.cm.UntagPeer(first, ReservationTag)
+	tracer.ReservationClosed(1)
+	if got := testutil.ToFloat64(oldestReservationAge); got != 60 {
+		t.Fatalf("oldest reservation age %f, want 60", got)
+	}
+	if !tracer.Granted(first).IsZero() {
+		t.Fatal("expired reservation still tracked")
+	}
+	if got := tracer.Granted(second); !got.Equal(clk.Now().Add(-time.Minute)) {
+		t.Fatalf("second reservation granted at %s", got)
+	}
+	if tracer.Reservations() != 1 {
+		t.Fatalf("%d reservations, want 1", tracer.Reservations())
+	}
+}
+
+func TestMetricsTracerMalformedStreams(t *testing.T) {
+	tracer := NewMetricsTracer(nopRelayTracer{}, newTestHost(), relayv2.Resources{})
+
+	for _, tc := range []struct {
+		request string
+		handle  func(pbv2.Status)
+	}{
+		{request: "reserve", handle: tracer.ReservationRequestHandled},
+		{request: "connect", handle: tracer.ConnectionRequestHandled},
+	} {
+		counter := counterWith(malformedStreams, "malformed_streams", tc.request)
+		before := testutil.ToFloat64(counter)
+
+		tc.handle(pbv2.Status_OK)
+		tc.handle(pbv2.Status_PERMISSION_DENIED)
+		tc.handle(pbv2.Status_MALFORMED_MESSAGE)
+
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s: %f malformed requests counted, want 1", tc.request, got)
+		}
+	}
+}
+
+func TestMetricsTracerReservationUtilization(t *testing.T) {
+	h := newTestHost()
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 4})
+
+	for _, step := range []struct {
+		name  string
+		event func()
+		want  float64
+	}{
+		{name: "grant", event: func() { tracer.ReservationAllowed(false) }, want: 0.25},
+		{name: "renewal", event: func() { tracer.ReservationAllowed(true) }, want: 0.25},
+		{name: "grants", event: func() {
+			for i := 0; i < 3; i++ {
+				tracer.ReservationAllowed(false)
+			}
+		}, want: 1},
+		{name: "garbage collection", event: func() { tracer.ReservationClosed(0) }, want: 1},
+		{name: "expiry", event: func() { tracer.ReservationClosed(2) }, want: 0.5},
+		{name: "all expired", event: func() { tracer.ReservationClosed(5) }, want: 0},
+	} {
+		step.event()
+		if got := testutil.ToFloat64(reservationUtilization); got != step.want {
+			t.Fatalf("%s: reservation utilization %g, want %g", step.name, got, step.want)
+		}
+	}
+}
+
+func TestMetricsTracerReservingSubnets(t *testing.T) {
+	h := newTestHost()
+	h.net.conns = make(map[peer.ID][]network.Conn)
+	tracer := NewMetricsTracer(nopRelayTracer{}, h, relayv2.Resources{MaxReservations: 8})
+
+	grant := func(name, ip string) peer.ID {
+		p := peer.ID(name)
+		c := newTestConn(ip, 4001, network.DirInbound)
+		c.peer = p
+		h.net.conns[p] = append(h.net.conns[p], c)
+		h.reserve(p)
+		tracer.ReservationAllowed(false)
+		return p
+	}
+	expire := func(p peer.ID) {
+		h.cm.UntagPeer(p, ReservationTag)
+		delete(h.net.connected, p)
+		delete(h.net.conns, p)
+		tracer.ReservationClosed(1)
+	}
+
+	for _, step := range []struct {
+		name  string
+		event func()
+		want  float64
+	}{
+		{name: "first subnet", event: func() { grant("a", "1.2.3.4") }, want: 1},
+		{name: "same IPv4 subnet", event: func() { grant("b", "1.2.3.5") }, want: 1},
+		{name: "other IPv4 subnet", event: func() { grant("c", "1.2.4.4") }, want: 2},
+		{name: "IPv6 subnet", event: func() { grant("d", "2001:db8::1") }, want: 3},
+		{name: "same IPv6 subnet", event: func() { grant("e", "2001:db8::ffff:1") }, want: 3},
+		{name: "other IPv6 subnet", event: func() { grant("f", "2001:db8:0:1::1") }, want: 4},
+		{name: "expiry in a shared subnet", event: func() { expire("b") }, want: 4},
+		{name: "expiry of a subnet", event: func() { expire("c") }, want: 3},
+	} {
+		step.event()
+		if got := testutil.ToFloat64(reservingSubnets); got != step.want {
+			t.Fatalf("%s: %g reserving subnets, want %g", step.name, got, step.want)
+		}
+	}
+}